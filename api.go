@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiNote is a JSON representation of a note used by the API
+type apiNote struct {
+	Path, Title  string
+	Text         string `json:",omitempty"`
+	Ctime, Mtime time.Time
+	Tags         []string
+	Meta         json.RawMessage `json:",omitempty"` // YAML front matter
+}
+
+// serveAPI handles JSON API requests under the /.api/ prefix
+func (h *handler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/.api/v1/")
+	if !ok {
+		apiError(w, "Unknown API version", http.StatusNotFound)
+		return
+	}
+	switch {
+	case rest == "notes":
+		switch r.Method {
+		case http.MethodGet:
+			h.apiListNotes(w, r)
+		case http.MethodPost:
+			h.apiCreateNote(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			apiError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(rest, "notes/"):
+		p := strings.TrimPrefix(rest, "notes/")
+		if p == "" || p == "." || !fs.ValidPath(p) {
+			apiError(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			h.apiGetNote(w, r, p)
+		case http.MethodPut:
+			h.apiPutNote(w, r, p)
+		case http.MethodDelete:
+			h.apiDeleteNote(w, r, p)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			apiError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	case rest == "move" && r.Method == http.MethodPost:
+		h.apiMoveNote(w, r)
+	case rest == "move":
+		w.Header().Set("Allow", "POST")
+		apiError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case rest == "search" && r.Method == http.MethodGet:
+		h.apiSearch(w, r)
+	case rest == "tags" && r.Method == http.MethodGet:
+		h.apiTags(w, r)
+	case rest == "search" || rest == "tags":
+		w.Header().Set("Allow", "GET")
+		apiError(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		apiError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+func (h *handler) apiListNotes(w http.ResponseWriter, r *http.Request) {
+	const defaultLimit, maxLimit = 100, 1000
+	limit, offset := defaultLimit, 0
+	vals := r.URL.Query()
+	if s := vals.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxLimit {
+			apiError(w, fmt.Sprintf("limit must be in [1,%d] range", maxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if s := vals.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			apiError(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	rows, err := h.stNotesPage.QueryContext(r.Context(), sql.Named("limit", limit), sql.Named("offset", offset))
+	if err != nil {
+		log.Printf("api list notes: %v", err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	out := struct {
+		Notes []apiNote
+		Next  string `json:",omitempty"`
+	}{Notes: []apiNote{}}
+	for rows.Next() {
+		var note apiNote
+		var ctime, mtime int64
+		var tagsJson, metaJson []byte
+		if err := rows.Scan(&note.Path, &note.Title, &ctime, &mtime, &tagsJson, &metaJson); err != nil {
+			log.Printf("api list notes: %v", err)
+			apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		note.Ctime, note.Mtime = time.Unix(ctime, 0).UTC(), time.Unix(mtime, 0).UTC()
+		if len(tagsJson) != 0 {
+			_ = json.Unmarshal(tagsJson, &note.Tags)
+		}
+		if len(metaJson) != 0 {
+			note.Meta = metaJson
+		}
+		out.Notes = append(out.Notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("api list notes: %v", err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(out.Notes) == limit {
+		out.Next = "/.api/v1/notes?" + url.Values{
+			"limit":  {strconv.Itoa(limit)},
+			"offset": {strconv.Itoa(offset + limit)},
+		}.Encode()
+	}
+	apiReply(w, out, http.StatusOK)
+}
+
+func (h *handler) apiGetNote(w http.ResponseWriter, r *http.Request, p string) {
+	note, err := h.getNote(r.Context(), p)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		apiError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	default:
+		log.Printf("api get %q: %v", p, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(textVersion(note.Text)))
+	apiReply(w, note, http.StatusOK)
+}
+
+func (h *handler) apiCreateNote(w http.ResponseWriter, r *http.Request) {
+	req, err := readNoteRequest(w, r)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := strings.TrimLeft(req.Path, "/")
+	if p == "" || p == "." || !fs.ValidPath(p) || reservedPath(p) {
+		apiError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	h.apiSaveNote(w, r, p, req.Text, new(string))
+}
+
+func (h *handler) apiPutNote(w http.ResponseWriter, r *http.Request, p string) {
+	req, err := readNoteRequest(w, r)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reservedPath(p) {
+		apiError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var expect *string
+	if v, ok := requestPrecondition(r); ok {
+		expect = &v
+	}
+	h.apiSaveNote(w, r, p, req.Text, expect)
+}
+
+func (h *handler) apiSaveNote(w http.ResponseWriter, r *http.Request, p, text string, expect *string) {
+	text, err := cleanText(text)
+	if err != nil {
+		apiError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	created, err := h.saveNote(r.Context(), p, text, expect)
+	var ce *conflictError
+	switch {
+	case err == nil:
+	case errors.As(err, &ce) && r.Method == http.MethodPost:
+		apiError(w, "Note already exists", http.StatusConflict)
+		return
+	case errors.As(err, &ce):
+		apiError(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	default:
+		log.Printf("api save %q: %v", p, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	note, err := h.getNote(r.Context(), p)
+	if err != nil {
+		log.Printf("api save %q: %v", p, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(textVersion(note.Text)))
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+		w.Header().Set("Location", (&url.URL{Path: "/.api/v1/notes/" + p}).String())
+	}
+	apiReply(w, note, code)
+}
+
+func (h *handler) apiDeleteNote(w http.ResponseWriter, r *http.Request, p string) {
+	switch err := h.deleteNote(r.Context(), p); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case sql.ErrNoRows:
+		apiError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	default:
+		log.Printf("api delete %q: %v", p, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func (h *handler) apiMoveNote(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From, To     string
+		RewriteLinks bool
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, fmt.Sprintf("decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	from, to := strings.TrimLeft(req.From, "/"), strings.TrimLeft(req.To, "/")
+	for _, p := range [...]string{from, to} {
+		if p == "" || p == "." || !fs.ValidPath(p) {
+			apiError(w, "Invalid path", http.StatusBadRequest)
+			return
+		}
+	}
+	if reservedPath(to) {
+		apiError(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	switch err := h.moveNote(r.Context(), from, to, req.RewriteLinks); err {
+	case nil:
+	case sql.ErrNoRows:
+		apiError(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	case errNoteExists:
+		apiError(w, "Note already exists", http.StatusConflict)
+		return
+	default:
+		log.Printf("api move %q to %q: %v", from, to, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	note, err := h.getNote(r.Context(), to)
+	if err != nil {
+		log.Printf("api move %q to %q: %v", from, to, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", strconv.Quote(textVersion(note.Text)))
+	apiReply(w, note, http.StatusOK)
+}
+
+func (h *handler) apiSearch(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		apiError(w, "Empty search query", http.StatusBadRequest)
+		return
+	}
+	res, err := searchNotes(r.Context(), h.db, q, r.URL.Query().Get("advanced") != "")
+	if err != nil && err != sql.ErrNoRows {
+		if isSyntaxError(err) {
+			apiError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("api search for %q: %v", q, err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	type result struct {
+		Path, Title string
+		Tags        []string
+		Snippet     string // HTML fragment with matches wrapped in <mark> elements
+	}
+	type fileResult struct {
+		Path    string
+		Notes   []noteTitle // notes the file is attached to
+		Snippet string
+	}
+	out := struct {
+		Query       string `json:",omitempty"` // set if the query was rewritten to fix its syntax
+		Approximate bool   `json:",omitempty"` // set if results only have similar words
+		Results     []result
+		Files       []fileResult `json:",omitempty"` // uploaded files with matching text
+	}{Query: res.Rewritten, Approximate: res.Approximate, Results: []result{}}
+	for _, ent := range res.Entries {
+		out.Results = append(out.Results, result{
+			Path:    ent.Path,
+			Title:   ent.Title,
+			Tags:    ent.Tags,
+			Snippet: string(ent.Snippet),
+		})
+	}
+	for _, f := range res.Files {
+		out.Files = append(out.Files, fileResult{Path: f.Path, Notes: f.Notes, Snippet: string(f.Snippet)})
+	}
+	apiReply(w, out, http.StatusOK)
+}
+
+func (h *handler) apiTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := allTags(r.Context(), h.stTags)
+	if err != nil {
+		log.Printf("api tags: %v", err)
+		apiError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if tags == nil {
+		tags = []tagInfo{}
+	}
+	apiReply(w, struct{ Tags []tagInfo }{Tags: tags}, http.StatusOK)
+}
+
+// getNote returns the note stored at path p
+func (h *handler) getNote(ctx context.Context, p string) (*apiNote, error) {
+	note := &apiNote{Path: p}
+	var ctime, mtime int64
+	var tagsJson, metaJson []byte
+	if err := h.stGetNote.QueryRowContext(ctx, sql.Named("path", p)).Scan(&note.Title, &note.Text, &ctime, &mtime, &tagsJson, &metaJson); err != nil {
+		return nil, err
+	}
+	if len(metaJson) != 0 {
+		note.Meta = metaJson
+	}
+	note.Ctime, note.Mtime = time.Unix(ctime, 0).UTC(), time.Unix(mtime, 0).UTC()
+	if len(tagsJson) != 0 {
+		if err := json.Unmarshal(tagsJson, &note.Tags); err != nil {
+			log.Printf("unmarshaling %q tags %q: %v", p, tagsJson, err)
+		}
+	}
+	return note, nil
+}
+
+// rawPage serves note source text
+func (h *handler) rawPage(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	note, err := h.getNote(r.Context(), p)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Printf("get %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Last-Modified", note.Mtime.Format(http.TimeFormat))
+	w.Header().Set("ETag", strconv.Quote(textVersion(note.Text)))
+	io.WriteString(w, note.Text)
+}
+
+// wantsMarkdown reports whether request explicitly asks for the note source
+// text instead of its rendered form
+func wantsMarkdown(r *http.Request) bool {
+	if r.URL.Query().Has("raw") {
+		return true
+	}
+	for _, s := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(s); err == nil && mt == "text/markdown" {
+			return true
+		}
+	}
+	return false
+}
+
+// apiNoteRequest is a body of requests creating or updating notes
+type apiNoteRequest struct {
+	Path string // only used when creating a note
+	Text string
+}
+
+// readNoteRequest decodes request body. Requests with text/* content type are
+// treated as note text.
+func readNoteRequest(w http.ResponseWriter, r *http.Request) (apiNoteRequest, error) {
+	const sizeLimit = 10 << 20
+	r.Body = http.MaxBytesReader(w, r.Body, sizeLimit)
+	var req apiNoteRequest
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasPrefix(mt, "text/") {
+		b, err := io.ReadAll(r.Body)
+		req.Text = string(b)
+		return req, err
+	}
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return req, fmt.Errorf("decoding request: %w", err)
+	}
+	return req, nil
+}
+
+func apiReply(w http.ResponseWriter, v any, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, msg string, code int) {
+	apiReply(w, struct{ Error string }{Error: msg}, code)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_apiSaveReservedPath(t *testing.T) {
+	h := newHandler(openTestDB(t))
+	for _, p := range [...]string{".files/x", ".login", ".api/v1/notes/x"} {
+		w := httptest.NewRecorder()
+		h.apiCreateNote(w, httptest.NewRequest(http.MethodPost, "/.api/v1/notes",
+			strings.NewReader(`{"Path":"/`+p+`","Text":"# Note"}`)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST %q: got %d, want %d", p, w.Code, http.StatusBadRequest)
+		}
+		w = httptest.NewRecorder()
+		h.apiPutNote(w, httptest.NewRequest(http.MethodPut, "/.api/v1/notes/"+p, strings.NewReader(`{"Text":"# Note"}`)), p)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %q: got %d, want %d", p, w.Code, http.StatusBadRequest)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.apiPutNote(w, httptest.NewRequest(http.MethodPut, "/.api/v1/notes/a/.b", strings.NewReader(`{"Text":"# Note"}`)), "a/.b")
+	if w.Code >= 300 {
+		t.Errorf("PUT %q: got %d %q", "a/.b", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artyom/notes-server/internal/webauthn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie = "session"
+	sessionTTL    = 30 * 24 * time.Hour
+	challengeTTL  = 5 * time.Minute
+)
+
+// authenticator requires requests to come from a logged in user once a
+// password or a passkey is set up. Logged in users get a session cookie
+// signed with a key kept in the database. Unless requireAll is set, requests
+// from loopback and private network addresses are let in without login.
+type authenticator struct {
+	db           *sql.DB
+	requireAll   bool
+	stState      *sql.Stmt
+	stPassword   *sql.Stmt
+	stPasskey    *sql.Stmt
+	stPasskeys   *sql.Stmt
+	stAddPasskey *sql.Stmt
+	stUsePasskey *sql.Stmt
+	stDelPasskey *sql.Stmt
+
+	mu         sync.Mutex
+	challenges map[string]time.Time            // passkey challenges not used yet, to their expiry time
+	failures   map[netip.Prefix]*loginFailures // recent failed password checks by client network
+}
+
+// loginFailures tracks consecutive failed password checks of a client
+type loginFailures struct {
+	count    int
+	until    time.Time // password checks are refused until this time
+	checking bool      // a password check is in progress
+}
+
+func newAuthenticator(db *sql.DB, requireAll bool) *authenticator {
+	return &authenticator{
+		db:         db,
+		requireAll: requireAll,
+		stState: mustPrepare(db, `SELECT (SELECT Value FROM auth WHERE Key='session'),
+			EXISTS(SELECT 1 FROM auth WHERE Key='password'), EXISTS(SELECT 1 FROM passkeys)`),
+		stPassword:   mustPrepare(db, `SELECT Value FROM auth WHERE Key='password'`),
+		stPasskey:    mustPrepare(db, `SELECT PublicKey, SignCount FROM passkeys WHERE ID=@id`),
+		stPasskeys:   mustPrepare(db, `SELECT ID, Name, Ctime, Atime FROM passkeys ORDER BY Ctime`),
+		stAddPasskey: mustPrepare(db, `INSERT INTO passkeys(ID,PublicKey,Name,SignCount) VALUES(@id,@key,@name,@count)`),
+		stUsePasskey: mustPrepare(db, `UPDATE passkeys SET SignCount=@count, Atime=strftime('%s','now') WHERE ID=@id`),
+		stDelPasskey: mustPrepare(db, `DELETE FROM passkeys WHERE ID=@id`),
+		challenges:   make(map[string]time.Time),
+		failures:     make(map[netip.Prefix]*loginFailures),
+	}
+}
+
+// authState describes what login methods are set up
+type authState struct {
+	key      []byte // session signing key
+	password bool
+	passkeys bool
+}
+
+func (s authState) enabled() bool { return s.password || s.passkeys }
+
+func (a *authenticator) state(ctx context.Context) (authState, error) {
+	var s authState
+	err := a.stState.QueryRowContext(ctx).Scan(&s.key, &s.password, &s.passkeys)
+	return s, err
+}
+
+// require wraps h so that it only serves logged in users, redirecting others
+// to the login page
+func (a *authenticator) require(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.login", "/.login/challenge", "/.login/passkey", "/robots.txt", "/favicon.ico":
+			h.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/.assets/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s, err := a.state(r.Context())
+		if err != nil {
+			log.Printf("checking login: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !a.requireAll && (!s.enabled() || exemptAddr(r.RemoteAddr)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.enabled() && validSession(s.key, r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// for API clients, which can't log in with a form
+		if _, password, ok := r.BasicAuth(); ok && s.password {
+			switch err := a.checkPassword(r, password); err {
+			case nil:
+				h.ServeHTTP(w, r)
+				return
+			case errTooManyAttempts:
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+		}
+		if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, "/.api/") {
+			http.Redirect(w, r, "/.login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="notes", charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// exemptAddr reports whether requests from the address don't need login
+// unless the -require-login flag is set. Addresses in the 100.64.0.0/10 range,
+// allowed by default, are not exempt, as this range is shared by customers of
+// carriers using it. The address is the one of the client behind trusted
+// proxies, as set by accessHandler.
+func exemptAddr(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	return ip.IsLoopback() || ip.IsPrivate()
+}
+
+var (
+	errWrongPassword   = errors.New("Wrong password")
+	errTooManyAttempts = errors.New("Too many failed login attempts, try again later")
+)
+
+// checkPassword checks password sent with the request against the stored
+// one. Each client can only have one check in progress. After a failed check,
+// checks for the same client are refused with errTooManyAttempts for a
+// second, and for twice as long after each further failure, up to a minute.
+// Clients are told apart by their IPv4 address or IPv6 /64 network.
+func (a *authenticator) checkPassword(r *http.Request, password string) error {
+	client := clientNetwork(r.RemoteAddr)
+	a.mu.Lock()
+	f := a.failures[client]
+	if f != nil && (f.checking || time.Now().Before(f.until)) {
+		a.mu.Unlock()
+		return errTooManyAttempts
+	}
+	if f == nil {
+		f = new(loginFailures)
+		a.failures[client] = f
+	}
+	f.checking = true
+	a.mu.Unlock()
+
+	var hash []byte
+	err := a.stPassword.QueryRowContext(r.Context()).Scan(&hash)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	} else if err != sql.ErrNoRows {
+		log.Printf("checking password: %v", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f.checking = false
+	if err == nil {
+		delete(a.failures, client)
+		return nil
+	}
+	now := time.Now()
+	const maxDelay, forgetAfter = time.Minute, 10 * time.Minute
+	for k, f := range a.failures {
+		if !f.checking && now.Sub(f.until) > forgetAfter {
+			delete(a.failures, k)
+		}
+	}
+	f.count++
+	f.until = now.Add(min(time.Second<<min(f.count-1, 6), maxDelay))
+	a.failures[client] = f
+	return errWrongPassword
+}
+
+// clientNetwork returns the network identifying the client: its IPv4
+// address, or the /64 network of its IPv6 address, as these are usually
+// given out to a single host or home network
+func clientNetwork(remoteAddr string) netip.Prefix {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	addr := addrPort.Addr().Unmap()
+	bits := 32
+	if addr.Is6() {
+		bits = 64
+	}
+	p, _ := addr.Prefix(bits)
+	return p
+}
+
+// sessionValue returns the session cookie value expiring at the given time:
+// the expiry time in unix seconds and its signature
+func sessionValue(key []byte, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, payload)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func validSession(key []byte, r *http.Request) bool {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	payload, _, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil || time.Now().Unix() >= unix {
+		return false
+	}
+	return hmac.Equal([]byte(c.Value), []byte(sessionValue(key, time.Unix(unix, 0))))
+}
+
+func (a *authenticator) startSession(w http.ResponseWriter, r *http.Request) error {
+	s, err := a.state(r.Context())
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sessionValue(s.key, expires),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   requestScheme(r) == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// loginPage serves the /.login page and handles password login
+func (a *authenticator) loginPage(w http.ResponseWriter, r *http.Request) {
+	s, err := a.state(r.Context())
+	if err != nil {
+		log.Printf("login page: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Next, Error        string
+		Password, Passkeys bool
+	}{Next: localPath(r.FormValue("next")), Password: s.password, Passkeys: s.passkeys}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		err := a.checkPassword(r, r.PostFormValue("password"))
+		if err == nil {
+			if err := a.startSession(w, r); err != nil {
+				log.Printf("login: %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+		if err == errTooManyAttempts {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	loginTemplate.Execute(w, data)
+}
+
+// localPath returns p if it's a path on this server, or "/" otherwise, so
+// that login can't redirect to other sites
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, `/\`) {
+		return "/"
+	}
+	return p
+}
+
+func (a *authenticator) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/.login", http.StatusSeeOther)
+}
+
+// challenge replies with a new passkey challenge, used either for login or
+// for registering a passkey
+func (a *authenticator) challenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	a.mu.Lock()
+	for k, t := range a.challenges {
+		if now.After(t) {
+			delete(a.challenges, k)
+		}
+	}
+	const maxChallenges = 1000
+	full := len(a.challenges) >= maxChallenges
+	if !full {
+		a.challenges[string(b)] = now.Add(challengeTTL)
+	}
+	a.mu.Unlock()
+	if full {
+		http.Error(w, "Too many login attempts", http.StatusServiceUnavailable)
+		return
+	}
+	apiReply(w, struct {
+		Challenge []byte
+		RPID      string
+	}{Challenge: b, RPID: hostName(r.Host)}, http.StatusOK)
+}
+
+// expect returns what a passkey response to the request must match, taking
+// the challenge it was made for, so that it can only be used once
+func (a *authenticator) expect(r *http.Request, clientDataJSON []byte) (webauthn.Expect, error) {
+	challenge, err := webauthn.Challenge(clientDataJSON)
+	if err != nil {
+		return webauthn.Expect{}, err
+	}
+	a.mu.Lock()
+	expires, ok := a.challenges[string(challenge)]
+	delete(a.challenges, string(challenge))
+	a.mu.Unlock()
+	if !ok || time.Now().After(expires) {
+		return webauthn.Expect{}, errors.New("unknown or expired challenge")
+	}
+	return webauthn.Expect{Challenge: challenge, Origin: requestScheme(r) + "://" + r.Host, RPID: hostName(r.Host)}, nil
+}
+
+// requestScheme returns the scheme the client used, which may differ from
+// the one of the request to the server behind a TLS-terminating proxy. The
+// X-Forwarded-Proto header can be relied on, as accessHandler removes it from
+// requests that didn't come from trusted proxies.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+func hostName(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// passkeyLogin handles login with a passkey
+func (a *authenticator) passkeyLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		ID                []byte
+		ClientDataJSON    []byte
+		AuthenticatorData []byte
+		Signature         []byte
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	e, err := a.expect(r, req.ClientDataJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cred := webauthn.Credential{ID: req.ID}
+	switch err := a.stPasskey.QueryRowContext(r.Context(), sql.Named("id", req.ID)).Scan(&cred.PublicKey, &cred.SignCount); err {
+	case nil:
+	case sql.ErrNoRows:
+		http.Error(w, "Unknown passkey", http.StatusForbidden)
+		return
+	default:
+		log.Printf("passkey login: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	count, err := webauthn.VerifyAssertion(e, cred, webauthn.Assertion{
+		ClientDataJSON:    req.ClientDataJSON,
+		AuthenticatorData: req.AuthenticatorData,
+		Signature:         req.Signature,
+	})
+	if err != nil {
+		log.Printf("passkey login: %v", err)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if _, err := a.stUsePasskey.ExecContext(r.Context(), sql.Named("id", req.ID), sql.Named("count", count)); err != nil {
+		log.Printf("passkey login: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if err := a.startSession(w, r); err != nil {
+		log.Printf("passkey login: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// passkeysPage serves the /.passkeys page listing registered passkeys, and
+// handles registering new and removing existing ones
+func (a *authenticator) passkeysPage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			a.registerPasskey(w, r)
+			return
+		}
+		id, err := base64.StdEncoding.DecodeString(r.PostFormValue("delete"))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if err := a.removePasskey(w, r, id); err != nil {
+			log.Printf("removing passkey: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	type passkey struct {
+		ID           string
+		Name         string
+		Ctime, Atime time.Time
+	}
+	var keys []passkey
+	ids := []string{} // for the page script, which expects an array
+	err := func() error {
+		rows, err := a.stPasskeys.QueryContext(r.Context())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var k passkey
+			var id []byte
+			var ctime int64
+			var atime sql.NullInt64
+			if err := rows.Scan(&id, &k.Name, &ctime, &atime); err != nil {
+				return err
+			}
+			k.ID = base64.StdEncoding.EncodeToString(id)
+			k.Ctime = time.Unix(ctime, 0)
+			if atime.Valid {
+				k.Atime = time.Unix(atime.Int64, 0)
+			}
+			keys = append(keys, k)
+			ids = append(ids, k.ID)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		log.Printf("passkeys page: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	passkeysTemplate.Execute(w, struct {
+		Passkeys []passkey
+		IDs      []string
+	}{Passkeys: keys, IDs: ids})
+}
+
+// removePasskey removes the passkey and ends all sessions, as some of them
+// may have been started with this passkey, then starts a new session for the
+// user who removed it
+func (a *authenticator) removePasskey(w http.ResponseWriter, r *http.Request, id []byte) error {
+	ctx := r.Context()
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.StmtContext(ctx, a.stDelPasskey).ExecContext(ctx, sql.Named("id", id)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE auth SET Value=randomblob(32) WHERE Key='session'`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return a.startSession(w, r)
+}
+
+func (a *authenticator) registerPasskey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name              string
+		ClientDataJSON    []byte
+		AuthenticatorData []byte
+		PublicKey         []byte
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	e, err := a.expect(r, req.ClientDataJSON)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	cred, err := webauthn.VerifyRegistration(e, webauthn.Registration{
+		ClientDataJSON:    req.ClientDataJSON,
+		AuthenticatorData: req.AuthenticatorData,
+		PublicKey:         req.PublicKey,
+	})
+	if err != nil {
+		log.Printf("registering passkey: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "passkey"
+	}
+	if _, err := a.stAddPasskey.ExecContext(r.Context(), sql.Named("id", cred.ID), sql.Named("key", cred.PublicKey),
+		sql.Named("name", name), sql.Named("count", cred.SignCount)); err != nil {
+		log.Printf("registering passkey: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the first passkey turns login on, keep the user who registered it
+	// logged in
+	if err := a.startSession(w, r); err != nil {
+		log.Printf("registering passkey: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword sets the login password to the first line read from r, or
+// removes the password if the line is empty. Existing sessions are ended.
+func setPassword(ctx context.Context, db *sql.DB, r io.Reader) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if password == "" {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM auth WHERE Key='password'`); err != nil {
+			return err
+		}
+		log.Print("password removed")
+	} else {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO auth(Key,Value) VALUES('password',@hash)`,
+			sql.Named("hash", hash)); err != nil {
+			return err
+		}
+		log.Print("password set")
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE auth SET Value=randomblob(32) WHERE Key='session'`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_checkPassword(t *testing.T) {
+	db := openTestDB(t)
+	if err := setPassword(context.Background(), db, strings.NewReader("secret\n")); err != nil {
+		t.Fatal(err)
+	}
+	a := newAuthenticator(db, false)
+	check := func(remoteAddr, password string) error {
+		r := httptest.NewRequest("POST", "/.login", nil)
+		r.RemoteAddr = remoteAddr
+		return a.checkPassword(r, password)
+	}
+	for _, tc := range []struct {
+		remoteAddr, password string
+		want                 error
+	}{
+		{"192.0.2.1:1000", "guess", errWrongPassword},
+		{"192.0.2.1:1001", "secret", errTooManyAttempts},
+		{"192.0.2.2:1000", "secret", nil}, // other clients are not affected
+		{"[2001:db8::1]:1000", "guess", errWrongPassword},
+		{"[2001:db8::2]:1000", "guess", errTooManyAttempts}, // same /64 network
+		{"[2001:db8:0:1::1]:1000", "secret", nil},
+	} {
+		if err := check(tc.remoteAddr, tc.password); err != tc.want {
+			t.Errorf("%s with password %q: got %v, want %v", tc.remoteAddr, tc.password, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import "strings"
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// diffLine is a single line of a line-oriented diff
+type diffLine struct {
+	Op   diffOp
+	Text string
+}
+
+func (l diffLine) Equal() bool  { return l.Op == diffEqual }
+func (l diffLine) Delete() bool { return l.Op == diffDelete }
+func (l diffLine) Insert() bool { return l.Op == diffInsert }
+
+// diffLines returns a line-oriented diff transforming a into b. It finds the
+// longest common subsequence of lines after trimming common prefix and suffix;
+// if the remaining middle part is too large, it is reported as fully replaced.
+func diffLines(a, b string) []diffLine {
+	al, bl := splitLines(a), splitLines(b)
+	var prefix, suffix int
+	for prefix < len(al) && prefix < len(bl) && al[prefix] == bl[prefix] {
+		prefix++
+	}
+	for suffix < len(al)-prefix && suffix < len(bl)-prefix &&
+		al[len(al)-1-suffix] == bl[len(bl)-1-suffix] {
+		suffix++
+	}
+	out := make([]diffLine, 0, len(al)+len(bl))
+	for _, s := range al[:prefix] {
+		out = append(out, diffLine{Op: diffEqual, Text: s})
+	}
+	out = append(out, diffMiddle(al[prefix:len(al)-suffix], bl[prefix:len(bl)-suffix])...)
+	for _, s := range al[len(al)-suffix:] {
+		out = append(out, diffLine{Op: diffEqual, Text: s})
+	}
+	return out
+}
+
+func diffMiddle(a, b []string) []diffLine {
+	const maxCells = 4 << 20
+	var out []diffLine
+	if len(a)*len(b) > maxCells {
+		for _, s := range a {
+			out = append(out, diffLine{Op: diffDelete, Text: s})
+		}
+		for _, s := range b {
+			out = append(out, diffLine{Op: diffInsert, Text: s})
+		}
+		return out
+	}
+	// lcs[i][j] holds the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var i, j int
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, diffLine{Op: diffEqual, Text: a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, diffLine{Op: diffDelete, Text: a[i]})
+			i++
+		default:
+			out = append(out, diffLine{Op: diffInsert, Text: b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, diffLine{Op: diffDelete, Text: a[i]})
+	}
+	for ; j < len(b); j++ {
+		out = append(out, diffLine{Op: diffInsert, Text: b[j]})
+	}
+	return out
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffRow is a single row of a side-by-side diff view; either side may be
+// missing.
+type diffRow struct {
+	Left, Right       string
+	HasLeft, HasRight bool
+	Changed           bool
+}
+
+// sideBySide pairs deleted and inserted lines of a diff, so that they can be
+// presented as two columns.
+func sideBySide(lines []diffLine) []diffRow {
+	var out []diffRow
+	for i := 0; i < len(lines); {
+		if lines[i].Op == diffEqual {
+			out = append(out, diffRow{Left: lines[i].Text, Right: lines[i].Text, HasLeft: true, HasRight: true})
+			i++
+			continue
+		}
+		var dels, ins []string
+		for ; i < len(lines) && lines[i].Op != diffEqual; i++ {
+			if lines[i].Op == diffDelete {
+				dels = append(dels, lines[i].Text)
+			} else {
+				ins = append(ins, lines[i].Text)
+			}
+		}
+		for k := 0; k < len(dels) || k < len(ins); k++ {
+			row := diffRow{Changed: true}
+			if k < len(dels) {
+				row.Left, row.HasLeft = dels[k], true
+			}
+			if k < len(ins) {
+				row.Right, row.HasRight = ins[k], true
+			}
+			out = append(out, row)
+		}
+	}
+	return out
+}
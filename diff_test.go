@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func Test_diffLines(t *testing.T) {
+	const a = "one\ntwo\nthree\nfour\n"
+	const b = "one\n2\nthree\nfour\nfive"
+	want := []diffLine{
+		{Op: diffEqual, Text: "one"},
+		{Op: diffDelete, Text: "two"},
+		{Op: diffInsert, Text: "2"},
+		{Op: diffEqual, Text: "three"},
+		{Op: diffEqual, Text: "four"},
+		{Op: diffInsert, Text: "five"},
+	}
+	got := diffLines(a, b)
+	if !slices.Equal(got, want) {
+		t.Fatalf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+	rows := sideBySide(got)
+	if len(rows) != 5 {
+		t.Fatalf("got %d side-by-side rows, want 5: %+v", len(rows), rows)
+	}
+	if r := rows[1]; !r.Changed || r.Left != "two" || r.Right != "2" {
+		t.Fatalf("unexpected paired row: %+v", r)
+	}
+	if r := rows[4]; r.HasLeft || !r.HasRight || r.Right != "five" {
+		t.Fatalf("unexpected insert-only row: %+v", r)
+	}
+}
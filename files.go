@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/artyom/notes-server/internal/filegc"
+)
+
+// attachment describes a file uploaded to a note; thumbnails are not listed
+// separately
+type attachment struct {
+	Path       string
+	Size       int64
+	Ctime      time.Time   // time of upload to the note, or to the first note
+	Notes      []noteTitle // notes the file was uploaded to
+	Thumbnail  string      // path of the smallest thumbnail, if any
+	Referenced bool        // whether the note text links to the file
+	MediaType  string      // stored media type, empty for older uploads
+	Original   string      // file name as uploaded
+	Width      int         // image dimensions, zero if unknown
+	Height     int
+}
+
+// noteTitle holds path and title of a note
+type noteTitle struct{ Path, Title string }
+
+func (a attachment) Name() string     { return path.Base(a.Path) }
+func (a attachment) SizeText() string { return byteSize(a.Size).String() }
+
+// Type returns media type of the file, guessing it from its name if the type
+// wasn't stored on upload
+func (a attachment) Type() string {
+	t := a.MediaType
+	if t == "" {
+		t = mime.TypeByExtension(path.Ext(a.Path))
+	}
+	if t != "" {
+		t, _, _ = strings.Cut(t, ";")
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (a attachment) IsImage() bool { return strings.HasPrefix(a.Type(), "image/") }
+
+// Preview returns path of the image to show in file listings
+func (a attachment) Preview() string {
+	if a.Thumbnail != "" {
+		return a.Thumbnail
+	}
+	return a.Path
+}
+
+// noteFiles serves the /path?files page listing the note attachments
+func (h *handler) noteFiles(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var text string
+	switch err := h.stEditPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&text); err {
+	case nil:
+	case sql.ErrNoRows:
+		pageNotFound(w, r)
+		return
+	default:
+		log.Printf("files of %q: %v", p, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	files, err := h.listFiles(r.Context(), p)
+	if err != nil {
+		log.Printf("files of %q: %v", p, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for i := range files {
+		files[i].Referenced = referencesFile(text, files[i].Path)
+	}
+	filesTemplate.Execute(w, struct {
+		Path, Title string
+		Files       []attachment
+	}{
+		Path:  p,
+		Title: parseNote(text).Title,
+		Files: files,
+	})
+}
+
+// listFiles returns attachments of the note at notePath, or of all notes if
+// notePath is empty, most recent first
+func (h *handler) listFiles(ctx context.Context, notePath string) ([]attachment, error) {
+	rows, err := h.stListFiles.QueryContext(ctx, sql.Named("notepath", notePath))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []attachment
+	for rows.Next() {
+		var a attachment
+		var ctime int64
+		var thumb sql.NullString
+		var notes []byte
+		if err := rows.Scan(&a.Path, &a.Size, &ctime, &thumb, &notes,
+			&a.MediaType, &a.Original, &a.Width, &a.Height); err != nil {
+			return nil, err
+		}
+		var pairs [][2]string
+		if err := json.Unmarshal(notes, &pairs); err != nil {
+			return nil, err
+		}
+		for _, p := range pairs {
+			a.Notes = append(a.Notes, noteTitle{Path: p[0], Title: p[1]})
+		}
+		a.Ctime = time.Unix(ctime, 0)
+		a.Thumbnail = thumb.String
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// referencesFile reports whether text links to the uploaded file at fPath or
+// to any of its thumbnails
+func referencesFile(text, fPath string) bool {
+	if strings.Contains(text, fileURL(fPath)) || strings.Contains(text, "/"+fPath) {
+		return true
+	}
+	for _, w := range thumbnailWidths {
+		if strings.Contains(text, fileURL(thumbnailPath(fPath, w))) {
+			return true
+		}
+	}
+	return false
+}
+
+// filesAction handles POST requests to the /path?files page
+func (h *handler) filesAction(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		form, up, ok := h.readUploadForm(w, r, "replace")
+		if !ok {
+			return
+		}
+		defer up.tf.Remove()
+		err = h.replaceFile(r.Context(), p, form.Get("file"), up)
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fPath := r.PostForm.Get("file")
+		switch {
+		case r.PostForm.Get("delete") == "true":
+			err = h.deleteFile(r.Context(), p, fPath)
+		case r.PostForm.Has("rename"):
+			err = h.renameFile(r.Context(), p, fPath, strings.TrimSpace(r.PostForm.Get("rename")))
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	}
+	switch {
+	case err == nil:
+		http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "No such file", http.StatusNotFound)
+	case errors.Is(err, errBadFilename):
+		http.Error(w, "Bad file name", http.StatusBadRequest)
+	default:
+		h.uploadFailed(w, err)
+	}
+}
+
+// deleteFile detaches the file from the note; the file with its thumbnails is
+// removed unless other notes use it. Links to it in the note text are left as
+// is.
+func (h *handler) deleteFile(ctx context.Context, notePath, fPath string) error {
+	res, err := h.db.ExecContext(ctx, `DELETE FROM note_files WHERE NotePath=@notepath AND Path=@path`,
+		sql.Named("notepath", notePath), sql.Named("path", fPath))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// renameFile changes name of the file attached to the note, updating links to
+// it and its thumbnails in the note text. Other notes sharing the file keep
+// it under the old name.
+func (h *handler) renameFile(ctx context.Context, notePath, fPath, name string) error {
+	name, err := validateFilename(name)
+	if err != nil {
+		return err
+	}
+	newPath := path.Join(path.Dir(fPath), name)
+	if newPath == fPath {
+		return nil
+	}
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	renames, err := fileRenames(ctx, tx, notePath, fPath, func(p string) string {
+		return path.Join(path.Dir(p), name)
+	})
+	if err != nil {
+		return err
+	}
+	// files are named after their content hash, so if the new path is
+	// already taken, it holds the same file
+	for old, new := range renames {
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO files(Path,Hash,Size,Ctime,Original,SourceHash,Type,Name,Width,Height)
+			SELECT @new,Hash,Size,Ctime,iif(Original IS NULL,NULL,@newpath),SourceHash,Type,Name,Width,Height FROM files WHERE Path=@old`,
+			sql.Named("old", old), sql.Named("new", new), sql.Named("newpath", newPath)); err != nil {
+			return err
+		}
+	}
+	if err := swapNoteFile(ctx, tx, notePath, fPath, newPath); err != nil {
+		return err
+	}
+	if err := h.rewriteFileLinks(ctx, tx, notePath, renames, "", ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// swapNoteFile attaches the file at newPath to the note in place of the file
+// at oldPath
+func swapNoteFile(ctx context.Context, tx *sql.Tx, notePath, oldPath, newPath string) error {
+	for _, s := range [...]string{
+		`INSERT OR IGNORE INTO note_files(NotePath,Path,Ctime)
+			SELECT NotePath,@new,Ctime FROM note_files WHERE NotePath=@notepath AND Path=@old`,
+		`DELETE FROM note_files WHERE NotePath=@notepath AND Path=@old`,
+	} {
+		if _, err := tx.ExecContext(ctx, s, sql.Named("notepath", notePath),
+			sql.Named("old", oldPath), sql.Named("new", newPath)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileRenames returns paths of the file and its thumbnails mapped to their new
+// paths as returned by fn. It returns sql.ErrNoRows if the file is not
+// attached to the note.
+func fileRenames(ctx context.Context, tx *sql.Tx, notePath, fPath string, fn func(string) string) (map[string]string, error) {
+	var attached bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM note_files WHERE NotePath=@notepath AND Path=@path)`,
+		sql.Named("notepath", notePath), sql.Named("path", fPath)).Scan(&attached); err != nil {
+		return nil, err
+	}
+	if !attached {
+		return nil, sql.ErrNoRows
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT Path FROM files WHERE Path=@path OR Original=@path`,
+		sql.Named("path", fPath))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]string)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out[p] = fn(p)
+	}
+	return out, rows.Err()
+}
+
+// replaceFile uploads a new file to the note in place of the file at fPath,
+// and updates links in the note text to point to the new file
+func (h *handler) replaceFile(ctx context.Context, notePath, fPath string, up fileUpload) error {
+	var attached bool
+	if err := h.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM note_files WHERE NotePath=@notepath AND Path=@path)`,
+		sql.Named("notepath", notePath), sql.Named("path", fPath)).Scan(&attached); err != nil {
+		return err
+	}
+	if !attached {
+		return sql.ErrNoRows
+	}
+	newPath, link, err := h.storeUpload(ctx, notePath, up)
+	if err != nil {
+		return err
+	}
+	if newPath == fPath {
+		return nil
+	}
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// links to thumbnails are updated to the new thumbnails of the same
+	// width, or to the new file itself if it has no such thumbnail
+	newThumbs := make(map[string]struct{})
+	rows, err := tx.QueryContext(ctx, `SELECT Path FROM files WHERE Original=@path`, sql.Named("path", newPath))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		newThumbs[p] = struct{}{}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	renames, err := fileRenames(ctx, tx, notePath, fPath, func(p string) string {
+		if p == fPath {
+			return newPath
+		}
+		t := path.Join(path.Dir(newPath), path.Base(path.Dir(p)), path.Base(newPath))
+		if _, ok := newThumbs[t]; ok {
+			return t
+		}
+		return newPath
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM note_files WHERE NotePath=@notepath AND Path=@path`,
+		sql.Named("notepath", notePath), sql.Named("path", fPath)); err != nil {
+		return err
+	}
+	var imgTag string
+	if strings.HasPrefix(link, "<img") {
+		imgTag = link
+	}
+	if err := h.rewriteFileLinks(ctx, tx, notePath, renames, fPath, imgTag); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var imgTagRe = regexp.MustCompile(`<img\b[^>]*>`)
+
+// rewriteFileLinks updates links in the note text according to renames, which
+// map old file paths to the new ones. If imgTag is not empty, it replaces
+// <img> tags having imgPath as their source.
+func (h *handler) rewriteFileLinks(ctx context.Context, tx *sql.Tx, notePath string, renames map[string]string, imgPath, imgTag string) error {
+	var text string
+	if err := tx.StmtContext(ctx, h.stEditPage).QueryRowContext(ctx, sql.Named("path", notePath)).Scan(&text); err != nil {
+		return err
+	}
+	var oldnew []string
+	for old, new := range renames {
+		oldnew = append(oldnew, fileURL(old), fileURL(new))
+		if u := "/" + old; u != fileURL(old) {
+			oldnew = append(oldnew, u, fileURL(new))
+		}
+	}
+	newText := text
+	if imgTag != "" {
+		newText = imgTagRe.ReplaceAllStringFunc(newText, func(tag string) string {
+			if imgTagSource(tag) == imgPath {
+				return imgTag
+			}
+			return tag
+		})
+	}
+	newText = strings.NewReplacer(oldnew...).Replace(newText)
+	if newText == text {
+		return nil
+	}
+	return h.storeNote(ctx, tx, notePath, newText)
+}
+
+// imgTagSource returns path of the file in the src attribute of the <img> tag
+func imgTagSource(tag string) string {
+	_, s, ok := strings.Cut(tag, ` src="/`)
+	if !ok {
+		return ""
+	}
+	s, _, _ = strings.Cut(s, `"`)
+	if p, err := url.PathUnescape(s); err == nil {
+		return p
+	}
+	return s
+}
+
+// filesGallery serves the /.files/ page listing files uploaded to all notes
+func (h *handler) filesGallery(w http.ResponseWriter, r *http.Request) {
+	files, err := h.listFiles(r.Context(), "")
+	if err != nil {
+		log.Printf("files gallery: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	galleryTemplate.Execute(w, files)
+}
+
+// collectFilesLoop periodically removes uploaded files no note links to for
+// longer than the grace period
+func (h *handler) collectFilesLoop(ctx context.Context, grace time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		report, err := filegc.Run(ctx, h.db, h.blobs, filegc.Options{Grace: grace})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("removing unused files: %v", err)
+		}
+		if report != nil {
+			for _, f := range report.Files {
+				if f.Removed {
+					log.Printf("removed %s of %s, unused since %s", f.Path, strings.Join(f.Notes, ", "),
+						f.Orphaned.Format(time.DateTime))
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// filesHandler serves the gallery page at /.files/ with gallery, and the
+// uploaded files under it with files
+func filesHandler(gallery, files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/.files/" {
+			gallery.ServeHTTP(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
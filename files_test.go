@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	"image/png"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+)
+
+func Test_referencesFile(t *testing.T) {
+	const fPath = ".files/hash/my pic.png"
+	for _, tc := range []struct {
+		text string
+		want bool
+	}{
+		{"![](/.files/hash/my%20pic.png)", true},
+		{`<img src="/.files/hash/my pic.png">`, true},
+		{`<img srcset="/.files/hash/640w/my%20pic.png 640w">`, true},
+		{"[other](/.files/hash/other.png)", false},
+		{"[thumbnail of other](/.files/hash/320w/other.png)", false},
+		{"no links", false},
+	} {
+		if got := referencesFile(tc.text, fPath); got != tc.want {
+			t.Errorf("referencesFile(%q) = %t, want %t", tc.text, got, tc.want)
+		}
+	}
+}
+
+func Test_imgTagSource(t *testing.T) {
+	for _, tc := range []struct {
+		tag, want string
+	}{
+		{`<img width=10 height=10 src="/.files/hash/a.png" loading=lazy>`, ".files/hash/a.png"},
+		{`<img src="/.files/hash/my%20pic.png">`, ".files/hash/my pic.png"},
+		{`<img src="/.files/hash/100%.png">`, ".files/hash/100%.png"},
+		{`<img src="https://example.com/a.png">`, ""},
+		{`<img alt="no source">`, ""},
+	} {
+		if got := imgTagSource(tc.tag); got != tc.want {
+			t.Errorf("imgTagSource(%q) = %q, want %q", tc.tag, got, tc.want)
+		}
+	}
+}
+
+func Test_rewriteFileLinks(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	h := newHandler(db)
+	for _, tc := range []struct {
+		name            string
+		text            string
+		renames         map[string]string
+		imgPath, imgTag string
+		want            string
+	}{
+		{
+			name:    "escaped and raw paths",
+			text:    `![](/.files/h/my%20pic.png) [thumb](/.files/h/320w/my%20pic.png) <img src="/.files/h/my pic.png">`,
+			renames: map[string]string{".files/h/my pic.png": ".files/h/cat.png", ".files/h/320w/my pic.png": ".files/h/320w/cat.png"},
+			want:    `![](/.files/h/cat.png) [thumb](/.files/h/320w/cat.png) <img src="/.files/h/cat.png">`,
+		},
+		{
+			name:    "other files kept",
+			text:    "[a](/.files/h/a.txt) [b](/.files/h/b.txt)",
+			renames: map[string]string{".files/h/a.txt": ".files/h2/a.txt"},
+			want:    "[a](/.files/h2/a.txt) [b](/.files/h/b.txt)",
+		},
+		{
+			name:    "img tag replaced",
+			text:    `<img width=10 height=10 src="/.files/h/a.png" srcset="/.files/h/320w/a.png 320w"> [a](/.files/h/a.png)`,
+			renames: map[string]string{".files/h/a.png": ".files/h2/b.png", ".files/h/320w/a.png": ".files/h2/320w/b.png"},
+			imgPath: ".files/h/a.png",
+			imgTag:  `<img width=20 height=20 src="/.files/h2/b.png">`,
+			want:    `<img width=20 height=20 src="/.files/h2/b.png"> [a](/.files/h2/b.png)`,
+		},
+		{
+			name:    "img tag of other file kept",
+			text:    `<img src="/.files/h/other.png">`,
+			renames: map[string]string{".files/h/a.png": ".files/h2/b.png"},
+			imgPath: ".files/h/a.png",
+			imgTag:  `<img src="/.files/h2/b.png">`,
+			want:    `<img src="/.files/h/other.png">`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES(?, '', ?)`, tc.name, tc.text); err != nil {
+				t.Fatal(err)
+			}
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if err := h.rewriteFileLinks(ctx, tx, tc.name, tc.renames, tc.imgPath, tc.imgTag); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if got := noteText(t, db, tc.name); got != tc.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_renameFile(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	const text = "![](/.files/h/my%20pic.png) [thumb](/.files/h/320w/my%20pic.png)"
+	for _, s := range [...]string{
+		`INSERT INTO notes(Path, Title, Text) VALUES('a', '', '` + text + `'), ('b', '', '` + text + `')`,
+		`INSERT INTO files(Path, Hash, Size, Original) VALUES('.files/h/my pic.png', 'h', 1, NULL),
+			('.files/h/320w/my pic.png', 'h320', 1, '.files/h/my pic.png')`,
+		`INSERT INTO note_files(NotePath, Path) VALUES('a', '.files/h/my pic.png'), ('b', '.files/h/my pic.png')`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newHandler(db)
+	if err := h.renameFile(ctx, "a", ".files/h/my pic.png", "cat.png"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := noteText(t, db, "a"), "![](/.files/h/cat.png) [thumb](/.files/h/320w/cat.png)"; got != want {
+		t.Errorf("renamed note text:\n%s\nwant:\n%s", got, want)
+	}
+	if got := noteText(t, db, "b"); got != text {
+		t.Errorf("other note text changed:\n%s", got)
+	}
+	if got, want := noteFilePaths(t, db, "a"), []string{".files/h/cat.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("renamed note files: got %q, want %q", got, want)
+	}
+	if got, want := noteFilePaths(t, db, "b"), []string{".files/h/my pic.png"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("other note files: got %q, want %q", got, want)
+	}
+	var original string
+	if err := db.QueryRowContext(ctx, `SELECT Original FROM files WHERE Path='.files/h/320w/cat.png'`).Scan(&original); err != nil {
+		t.Fatalf("renamed thumbnail: %v", err)
+	}
+	if original != ".files/h/cat.png" {
+		t.Errorf("renamed thumbnail original is %q", original)
+	}
+
+	for _, tc := range []struct {
+		note, file, name string
+		err              error
+	}{
+		{"a", ".files/h/my pic.png", "x.png", sql.ErrNoRows},
+		{"a", ".files/h/cat.png", "..", errBadFilename},
+		{"a", ".files/h/cat.png", "", errBadFilename},
+	} {
+		if err := h.renameFile(ctx, tc.note, tc.file, tc.name); err != tc.err {
+			t.Errorf("renameFile(%q, %q, %q): got %v, want %v", tc.note, tc.file, tc.name, err, tc.err)
+		}
+	}
+}
+
+func Test_replaceFile(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	h.blobs = blobs
+	const text = `<img src="/.files/h/a.png" srcset="/.files/h/320w/a.png 320w, /.files/h/640w/a.png 640w">
+
+[small](/.files/h/320w/a.png) [medium](/.files/h/640w/a.png)`
+	for _, s := range [...]string{
+		`INSERT INTO notes(Path, Title, Text) VALUES('note', '', '` + text + `')`,
+		`INSERT INTO files(Path, Hash, Size, Original) VALUES('.files/h/a.png', 'h', 1, NULL),
+			('.files/h/320w/a.png', 'h320', 1, '.files/h/a.png'), ('.files/h/640w/a.png', 'h640', 1, '.files/h/a.png')`,
+		`INSERT INTO note_files(NotePath, Path) VALUES('note', '.files/h/a.png')`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the new image only gets a 320 pixels wide thumbnail; it is noisy, so
+	// that the thumbnail is smaller than the image
+	img := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	rand.New(rand.NewSource(1)).Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	tf, err := spoolUpload(&buf, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tf.Remove()
+	if err := h.replaceFile(ctx, "note", ".files/h/a.png", fileUpload{name: "b.png", tf: tf}); err != nil {
+		t.Fatal(err)
+	}
+	newPath := ".files/" + tf.hash() + "/b.png"
+	if got, want := noteFilePaths(t, db, "note"), []string{newPath}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("note files: got %q, want %q", got, want)
+	}
+	got := noteText(t, db, "note")
+	tag, links, _ := strings.Cut(got, "\n\n")
+	if imgTagSource(tag) != newPath || !strings.Contains(tag, fileURL(thumbnailPath(newPath, 320))+" 320w") {
+		t.Errorf("img tag not replaced with the new one: %s", tag)
+	}
+	if want := "[small](" + fileURL(thumbnailPath(newPath, 320)) + ") [medium](" + fileURL(newPath) + ")"; links != want {
+		t.Errorf("got links:\n%s\nwant:\n%s", links, want)
+	}
+
+	if err := h.replaceFile(ctx, "note", ".files/h/a.png", fileUpload{name: "b.png", tf: tf}); err != sql.ErrNoRows {
+		t.Errorf("replacing file not attached to the note: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func noteText(t *testing.T, db *sql.DB, notePath string) string {
+	t.Helper()
+	var text string
+	if err := db.QueryRow(`SELECT Text FROM notes WHERE Path=?`, notePath).Scan(&text); err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+func noteFilePaths(t *testing.T, db *sql.DB, notePath string) []string {
+	t.Helper()
+	rows, err := db.Query(`SELECT Path FROM note_files WHERE NotePath=? ORDER BY Path`, notePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, p)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/artyom/notes-server/internal/markdown"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+// noteData holds data derived from the note text. Values set in the YAML front
+// matter take precedence over the ones derived from the note body: title from
+// its first line, and tags from the tags comment.
+type noteData struct {
+	Title string
+	Tags  []string
+	Ctime time.Time // from the "created" front matter key, zero if not set
+	Meta  []byte    // front matter as a JSON object, nil if note has none
+	Body  string    // text without the front matter
+}
+
+func parseNote(text string) noteData {
+	meta, body := markdown.FrontMatter([]byte(text))
+	out := noteData{Body: string(body)}
+	if s, ok := meta["title"].(string); ok {
+		out.Title = strings.TrimSpace(s)
+	}
+	if v, ok := meta["tags"]; ok {
+		out.Tags = metaTags(v)
+	} else {
+		out.Tags = noteTags(out.Body)
+	}
+	out.Ctime = metaTime(meta["created"])
+	if meta != nil {
+		out.Meta = metaJSON(meta)
+	}
+	if out.Title == "" {
+		out.Title = textTitle(out.Body)
+	}
+	return out
+}
+
+// metaJSON returns the front matter as a JSON object. Keys of nested mappings
+// are formatted as strings, as YAML allows keys of other types. Values that
+// still can't be encoded, like .nan, are logged and left out along with their
+// keys, so that the other keys keep working.
+func metaJSON(meta map[string]any) []byte {
+	obj := make(map[string]json.RawMessage, len(meta))
+	for k, v := range meta {
+		b, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			log.Printf("front matter key %q: %v", k, err)
+			continue
+		}
+		obj[k] = b
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// jsonValue returns v decoded from YAML with mappings having non-string keys
+// converted to ones with string keys
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[k] = jsonValue(val)
+		}
+		return out
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for k, val := range v {
+			out[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = jsonValue(val)
+		}
+		return out
+	}
+	return v
+}
+
+// columns returns values for the Tags, Meta and Ctime columns of the notes
+// table, nil values stand for NULL
+func (n noteData) columns() (tags, meta, ctime any) {
+	if len(n.Tags) != 0 {
+		b, err := json.Marshal(n.Tags)
+		if err != nil {
+			panic(err)
+		}
+		tags = b
+	}
+	if n.Meta != nil {
+		meta = string(n.Meta)
+	}
+	if !n.Ctime.IsZero() {
+		ctime = n.Ctime.Unix()
+	}
+	return tags, meta, ctime
+}
+
+// indexFrontMatter updates data derived from the front matter of notes saved
+// before front matter was supported
+func indexFrontMatter(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT Path, Text FROM notes WHERE Text LIKE '---%'`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	notes := make(map[string]noteData)
+	for rows.Next() {
+		var p, text string
+		if err := rows.Scan(&p, &text); err != nil {
+			return err
+		}
+		if note := parseNote(text); note.Meta != nil {
+			notes[p] = note
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for p, note := range notes {
+		tags, meta, ctime := note.columns()
+		if _, err := tx.ExecContext(ctx, `UPDATE notes SET Title=@title, Tags=@tags, Meta=@meta,
+			Ctime=coalesce(@ctime,Ctime) WHERE Path=@path`,
+			sql.Named("path", p),
+			sql.Named("title", note.Title),
+			sql.Named("tags", tags),
+			sql.Named("meta", meta),
+			sql.Named("ctime", ctime),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// metaTags returns tags from the front matter "tags" value, which can either
+// be a list or a comma-separated string
+func metaTags(v any) []string {
+	var ss []string
+	switch v := v.(type) {
+	case string:
+		ss = strings.Split(v, ",")
+	case []any:
+		for _, s := range v {
+			if s != nil {
+				ss = append(ss, fmt.Sprint(s))
+			}
+		}
+	}
+	var out []string
+	seen := make(map[string]struct{})
+	for _, s := range ss {
+		if s = strings.TrimSpace(s); !validTag(s) {
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
+
+// metaTime returns time from the front matter value, which can either be a
+// YAML timestamp or a string in one of the common formats
+func metaTime(v any) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	case string:
+		for _, layout := range [...]string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+			if t, err := time.Parse(layout, strings.TrimSpace(v)); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// replaceFrontMatterTag rewrites the "tags" value of the note front matter,
+// replacing the from tag with the to tag, or removing it if to is empty. It
+// reports whether the text was changed.
+func replaceFrontMatterTag(text, from, to string) (string, bool) {
+	front, _, ok := markdown.SplitFrontMatter([]byte(text))
+	if !ok {
+		return text, false
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(front, &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return text, false
+	}
+	var tags *yaml.Node
+	m := doc.Content[0]
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "tags" {
+			tags = m.Content[i+1]
+			break
+		}
+	}
+	if tags == nil {
+		return text, false
+	}
+	var found bool
+	switch tags.Kind {
+	case yaml.ScalarNode:
+		var out []string
+		for _, s := range strings.Split(tags.Value, ",") {
+			if s = strings.TrimSpace(s); s == from {
+				found, s = true, to
+			}
+			if s != "" && !slices.Contains(out, s) {
+				out = append(out, s)
+			}
+		}
+		tags.Value = strings.Join(out, ", ")
+	case yaml.SequenceNode:
+		var out []*yaml.Node
+		var seen []string
+		for _, n := range tags.Content {
+			if n.Kind == yaml.ScalarNode && strings.TrimSpace(n.Value) == from {
+				if found = true; to == "" {
+					continue
+				}
+				n.Value, n.Tag, n.Style = to, "!!str", 0
+			}
+			if n.Kind == yaml.ScalarNode {
+				if slices.Contains(seen, n.Value) {
+					continue
+				}
+				seen = append(seen, n.Value)
+			}
+			out = append(out, n)
+		}
+		tags.Content = out
+	}
+	if !found {
+		return text, false
+	}
+	buf := new(bytes.Buffer)
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return text, false
+	}
+	if err := enc.Close(); err != nil {
+		return text, false
+	}
+	start := strings.IndexByte(text, '\n') + 1
+	return text[:start] + buf.String() + text[start+len(front):], true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func Test_parseNote(t *testing.T) {
+	const text = "---\ntitle: From front matter\ntags: [a, b, a]\ncreated: 2023-05-01\naliases: [old]\n---\n# Heading\n<!-- Tags: c -->\n"
+	note := parseNote(text)
+	if note.Title != "From front matter" {
+		t.Errorf("got title %q", note.Title)
+	}
+	if want := []string{"a", "b"}; !slices.Equal(note.Tags, want) {
+		t.Errorf("got tags %q, want %q", note.Tags, want)
+	}
+	if want := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC); !note.Ctime.Equal(want) {
+		t.Errorf("got ctime %v, want %v", note.Ctime, want)
+	}
+	if want := `{"aliases":["old"],"created":"2023-05-01T00:00:00Z","tags":["a","b","a"],"title":"From front matter"}`; string(note.Meta) != want {
+		t.Errorf("got meta %s, want %s", note.Meta, want)
+	}
+	note = parseNote("---\nauthor: me\n---\n# Heading\n<!-- Tags: c -->\n")
+	if note.Title != "Heading" || !slices.Equal(note.Tags, []string{"c"}) {
+		t.Errorf("fallback to heuristics failed: %+v", note)
+	}
+}
+
+func Test_replaceFrontMatterTag(t *testing.T) {
+	for _, tc := range []struct {
+		text, from, to, want string
+	}{
+		{"---\ntags: [a, b]\n---\nBody", "a", "c", "---\ntags: [c, b]\n---\nBody"},
+		{"---\ntags:\n  - a\n  - b\n---\nBody", "a", "b", "---\ntags:\n  - b\n---\nBody"},
+		{"---\ntitle: x # comment\ntags: a, b\n---\nBody", "b", "", "---\ntitle: x # comment\ntags: a\n---\nBody"},
+		{"---\ntitle: x\n---\nBody", "a", "b", "---\ntitle: x\n---\nBody"},
+	} {
+		if got, _ := replaceFrontMatterTag(tc.text, tc.from, tc.to); got != tc.want {
+			t.Errorf("replaceFrontMatterTag(%q, %q, %q):\ngot:  %q\nwant: %q", tc.text, tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+func Test_parseNoteMeta(t *testing.T) {
+	for _, tc := range []struct {
+		front, want string
+	}{
+		{"aliases: [old]\nscores:\n  1: one\n  true: yes", `{"aliases":["old"],"scores":{"1":"one","true":"yes"}}`},
+		{"aliases: [old]\nlist:\n  - {2: two}", `{"aliases":["old"],"list":[{"2":"two"}]}`},
+		{"aliases: [old]\nratio: .nan", `{"aliases":["old"]}`},
+	} {
+		note := parseNote("---\n" + tc.front + "\n---\n# Heading\n")
+		if string(note.Meta) != tc.want {
+			t.Errorf("front matter %q: got meta %s, want %s", tc.front, note.Meta, tc.want)
+		}
+	}
+}
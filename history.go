@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"io/fs"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyEntry describes a single version of a note; zero ID stands for the
+// current version.
+type historyEntry struct {
+	ID    int64
+	Title string
+	Mtime time.Time
+}
+
+func (h *handler) pageHistory(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var versions []historyEntry
+	var text, title string
+	var mtime int64
+	var tagsJson []byte
+	switch err := h.stRenderPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&title, &text, &mtime, &tagsJson); err {
+	case nil:
+		versions = append(versions, historyEntry{Title: title, Mtime: time.Unix(mtime, 0)})
+	case sql.ErrNoRows:
+	default:
+		log.Printf("history %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rows, err := h.stHistory.QueryContext(r.Context(), sql.Named("path", p))
+	if err != nil {
+		log.Printf("history %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ent historyEntry
+		if err := rows.Scan(&ent.ID, &ent.Title, &mtime); err != nil {
+			log.Printf("history %q: %v", r.URL, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		ent.Mtime = time.Unix(mtime, 0)
+		versions = append(versions, ent)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("history %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		pageNotFound(w, r)
+		return
+	}
+	if title == "" {
+		title = versions[0].Title
+	}
+	historyTemplate.Execute(w, struct {
+		Path, Title string
+		Versions    []historyEntry
+	}{
+		Path:     p,
+		Title:    title,
+		Versions: versions,
+	})
+}
+
+func (h *handler) diffPage(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	vals := r.URL.Query()
+	var sides [2]struct {
+		historyEntry
+		text string
+	}
+	for i, key := range [...]string{"a", "b"} {
+		side := &sides[i]
+		if s := vals.Get(key); s != "" && s != "0" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid version id", http.StatusBadRequest)
+				return
+			}
+			side.ID = id
+		}
+		var err error
+		var mtime int64
+		if side.ID == 0 {
+			var tagsJson []byte
+			err = h.stRenderPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&side.Title, &side.text, &mtime, &tagsJson)
+		} else {
+			err = h.stVersion.QueryRowContext(r.Context(), sql.Named("path", p), sql.Named("id", side.ID)).Scan(&side.Title, &side.text, &mtime)
+		}
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			pageNotFound(w, r)
+			return
+		default:
+			log.Printf("diff %q: %v", r.URL, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		side.Mtime = time.Unix(mtime, 0)
+	}
+	lines := diffLines(sides[0].text, sides[1].text)
+	data := struct {
+		Path       string
+		Old, New   historyEntry
+		SideBySide bool
+		Lines      []diffLine
+		Rows       []diffRow
+	}{
+		Path:       p,
+		Old:        sides[0].historyEntry,
+		New:        sides[1].historyEntry,
+		SideBySide: vals.Get("view") == "split",
+	}
+	if data.SideBySide {
+		data.Rows = sideBySide(lines)
+	} else {
+		data.Lines = lines
+	}
+	diffTemplate.Execute(w, data)
+}
@@ -0,0 +1,165 @@
+// Package access decides which clients may use the server based on their
+// network addresses, finding the address of the client behind trusted reverse
+// proxies from the Forwarded and X-Forwarded-For request headers.
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultAllow lists loopback and private network ranges, including the
+// 100.64.0.0/10 shared address space used by carriers and some VPNs
+var DefaultAllow = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// Policy decides which clients may access the server. A client is allowed
+// if its address is in any of the Allow ranges and in none of the Deny ones.
+// If the request comes from one of the Proxies, the client address is taken
+// from the forwarding headers.
+type Policy struct {
+	Allow   []netip.Prefix
+	Deny    []netip.Prefix
+	Proxies []netip.Prefix
+}
+
+// Allowed reports whether the policy allows access from the address
+func (p *Policy) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return contains(p.Allow, addr) && !contains(p.Deny, addr)
+}
+
+// Client returns the address of the client that made the request. For
+// requests from trusted proxies, it's the rightmost address in the forwarding
+// headers that is not a trusted proxy itself: addresses to the left of it
+// could have been made up by the client. The Forwarded header takes
+// precedence over X-Forwarded-For.
+//
+// The proto reported by the closest trusted proxy is returned as well; it's
+// empty for requests that didn't come from a trusted proxy.
+func (p *Policy) Client(r *http.Request) (addr netip.Addr, proto string, err error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, "", fmt.Errorf("remote address %q: %w", r.RemoteAddr, err)
+	}
+	addr = addrPort.Addr().Unmap()
+	if !contains(p.Proxies, addr) {
+		return addr, "", nil
+	}
+	var hops []string
+	if values := r.Header.Values("Forwarded"); len(values) != 0 {
+		if hops, proto, err = parseForwarded(values); err != nil {
+			return netip.Addr{}, "", err
+		}
+	} else {
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, s := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(s))
+			}
+		}
+		if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+			protos := strings.Split(v, ",")
+			proto = strings.ToLower(strings.TrimSpace(protos[len(protos)-1]))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseNode(hops[i])
+		if err != nil {
+			return netip.Addr{}, "", err
+		}
+		addr = hop
+		if !contains(p.Proxies, addr) {
+			break
+		}
+	}
+	return addr, proto, nil
+}
+
+// parseForwarded returns the "for" parameters of the Forwarded header
+// values (RFC 7239), and the "proto" parameter of the last element
+func parseForwarded(values []string) (hops []string, proto string, err error) {
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			var hop string
+			proto = ""
+			for _, pair := range strings.Split(elem, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					if strings.TrimSpace(pair) == "" {
+						continue
+					}
+					return nil, "", fmt.Errorf("malformed Forwarded header %q", v)
+				}
+				val = strings.Trim(val, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					hop = val
+				case "proto":
+					proto = strings.ToLower(val)
+				}
+			}
+			if hop == "" {
+				return nil, "", fmt.Errorf("no client address in Forwarded header %q", v)
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops, proto, nil
+}
+
+var errNoAddr = errors.New("no IP address in forwarding header")
+
+// parseNode parses an address from a forwarding header, which may include a
+// port and have IPv6 addresses in square brackets
+func parseNode(s string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		// obfuscated identifiers and "unknown" can't be checked
+		return netip.Addr{}, fmt.Errorf("%w: %q", errNoAddr, s)
+	}
+	return addr.Unmap(), nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefixes parses a comma-separated list of CIDR ranges. Single
+// addresses are taken as ranges of one address.
+func ParsePrefixes(s string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(f); err == nil {
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p.Masked())
+	}
+	return out, nil
+}
@@ -0,0 +1,102 @@
+package access
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	must := func(s string) []netip.Prefix {
+		p, err := ParsePrefixes(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	p := &Policy{
+		Allow:   DefaultAllow,
+		Deny:    must("192.168.50.0/24, 10.1.2.3"),
+		Proxies: must("127.0.0.1, ::1"),
+	}
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		header    http.Header
+		want      string // client address, empty if an error is expected
+		wantProto string
+		allowed   bool
+	}{
+		{name: "direct private", remote: "192.168.1.10:5000", want: "192.168.1.10", allowed: true},
+		{name: "direct public", remote: "203.0.113.5:5000", want: "203.0.113.5"},
+		{name: "denied range", remote: "192.168.50.7:5000", want: "192.168.50.7"},
+		{name: "denied address", remote: "10.1.2.3:5000", want: "10.1.2.3"},
+		{name: "mapped IPv4", remote: "[::ffff:10.0.0.1]:5000", want: "10.0.0.1", allowed: true},
+		{name: "cgnat", remote: "100.100.1.1:5000", want: "100.100.1.1", allowed: true},
+		{name: "proxy without headers", remote: "127.0.0.1:5000", want: "127.0.0.1", allowed: true},
+		{
+			name:   "public behind proxy",
+			remote: "127.0.0.1:5000",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.5"}, "X-Forwarded-Proto": {"https"}},
+			want:   "203.0.113.5", wantProto: "https",
+		},
+		{
+			name:   "spoofed private address behind proxy",
+			remote: "127.0.0.1:5000",
+			header: http.Header{"X-Forwarded-For": {"192.168.1.10, 203.0.113.5"}},
+			want:   "203.0.113.5",
+		},
+		{
+			name:   "chain of trusted proxies",
+			remote: "[::1]:5000",
+			header: http.Header{"X-Forwarded-For": {"192.168.1.10", "127.0.0.1"}},
+			want:   "192.168.1.10", allowed: true,
+		},
+		{
+			name:   "untrusted sender of headers",
+			remote: "192.168.1.10:5000",
+			header: http.Header{"X-Forwarded-For": {"203.0.113.5"}},
+			want:   "192.168.1.10", allowed: true,
+		},
+		{
+			name:   "forwarded header",
+			remote: "127.0.0.1:5000",
+			header: http.Header{
+				"Forwarded":       {`for=192.168.1.10;proto=http, for="[2001:db8::17]:4711";proto=https`},
+				"X-Forwarded-For": {"10.0.0.1"},
+			},
+			want: "2001:db8::17", wantProto: "https",
+		},
+		{
+			name:   "forwarded header with private client",
+			remote: "127.0.0.1:5000",
+			header: http.Header{"Forwarded": {`for=192.168.1.10:1234;by=127.0.0.1`}},
+			want:   "192.168.1.10", allowed: true,
+		},
+		{
+			name:   "obfuscated address",
+			remote: "127.0.0.1:5000",
+			header: http.Header{"Forwarded": {`for=unknown`}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &http.Request{RemoteAddr: tc.remote, Header: tc.header}
+			addr, proto, err := p.Client(r)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("got %v, want error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != tc.want || proto != tc.wantProto {
+				t.Fatalf("got %v %q, want %v %q", addr, proto, tc.want, tc.wantProto)
+			}
+			if got := p.Allowed(addr); got != tc.allowed {
+				t.Fatalf("Allowed(%v) = %v, want %v", addr, got, tc.allowed)
+			}
+		})
+	}
+}
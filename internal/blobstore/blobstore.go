@@ -0,0 +1,109 @@
+// Package blobstore implements storages for file attachments. Blobs are
+// immutable and addressed by keys derived from their content, so storing the
+// same key twice is a no-op.
+package blobstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+// Store is a storage of immutable blobs
+type Store interface {
+	// Put stores size bytes read from r under the key, unless a blob with
+	// this key already exists
+	Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error
+	// Get returns blob stored under the key, or an error wrapping
+	// fs.ErrNotExist if there's none
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// Delete removes blob stored under the key, it is not an error if
+	// there's none
+	Delete(ctx context.Context, key string) error
+}
+
+// TxDeleter is implemented by stores keeping blobs in the database, which can
+// remove a blob as a part of the database transaction
+type TxDeleter interface {
+	DeleteTx(ctx context.Context, tx *sql.Tx, key string) error
+}
+
+// Open returns a Store described by spec, which is one of:
+//
+//	sqlite                  blob_chunks table in the db database
+//	dir:/path/to/dir        content-addressed local directory
+//	s3://bucket/prefix      S3 bucket, with optional query parameters:
+//	                        endpoint=URL for S3-compatible services,
+//	                        region=NAME, and path-style=true
+//
+// S3 credentials are taken from the usual AWS environment variables and
+// configuration files.
+func Open(ctx context.Context, spec string, db *sql.DB) (Store, error) {
+	return open(ctx, spec, db, false)
+}
+
+// OpenReadOnly returns a Store described by spec like Open does, but only
+// for reading blobs: it doesn't create the storage table or directory, and
+// refuses to store or remove blobs. It's meant for tools that may run along
+// with the server.
+func OpenReadOnly(ctx context.Context, spec string, db *sql.DB) (Store, error) {
+	s, err := open(ctx, spec, db, true)
+	if err != nil {
+		return nil, err
+	}
+	return readOnly{s}, nil
+}
+
+func open(ctx context.Context, spec string, db *sql.DB, readOnly bool) (Store, error) {
+	switch {
+	case spec == "sqlite" && readOnly:
+		return &sqliteStore{db: db, chunk: sqliteChunkSize}, nil
+	case spec == "sqlite":
+		return NewSQLite(ctx, db)
+	case strings.HasPrefix(spec, "dir:") && readOnly:
+		if dir := strings.TrimPrefix(spec, "dir:"); dir != "" {
+			return &dirStore{dir: dir}, nil
+		}
+		return nil, errors.New("empty directory name")
+	case strings.HasPrefix(spec, "dir:"):
+		return NewDir(strings.TrimPrefix(spec, "dir:"))
+	case strings.HasPrefix(spec, "s3://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		return openS3(ctx, u)
+	}
+	return nil, fmt.Errorf("unsupported blob storage %q", spec)
+}
+
+// Copy copies blob stored under the key from src to dst
+func Copy(ctx context.Context, dst, src Store, key string, size int64) error {
+	r, err := src.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return dst.Put(ctx, key, r, size)
+}
+
+// errReadOnly is returned by stores opened with OpenReadOnly on attempts to
+// change them
+var errReadOnly = errors.New("blob storage is opened read-only")
+
+type readOnly struct{ Store }
+
+func (readOnly) Put(context.Context, string, io.ReadSeeker, int64) error { return errReadOnly }
+func (readOnly) Delete(context.Context, string) error                    { return errReadOnly }
+
+// validKey reports whether key can be safely used as a file name
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`) && fs.ValidPath(key)
+}
+
+var errInvalidKey = errors.New("invalid blob key")
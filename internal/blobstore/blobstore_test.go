@@ -0,0 +1,222 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	_ "modernc.org/sqlite"
+)
+
+func TestStores(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	sqlite, err := NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(new(fakeS3))
+	defer srv.Close()
+	client := s3.New(s3.Options{
+		Region:           "us-east-1",
+		EndpointResolver: s3.EndpointResolverFromURL(srv.URL),
+		UsePathStyle:     true,
+	})
+	for name, s := range map[string]Store{
+		"sqlite":        sqlite,
+		"sqlite-chunks": &sqliteStore{db: db, chunk: 5},
+		"dir":           dir,
+		"s3":            NewS3(client, "bucket", "blobs/"),
+	} {
+		t.Run(name, func(t *testing.T) { testStore(t, s) })
+	}
+	t.Run("copy", func(t *testing.T) {
+		const key = "copied"
+		data := []byte("copied between stores")
+		if err := sqlite.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if err := Copy(ctx, dir, sqlite, key, int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(t, dir, key); got != string(data) {
+			t.Fatalf("got %q, want %q", got, data)
+		}
+	})
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	dir := t.TempDir() + "/blobs"
+	for _, spec := range []string{"sqlite", "dir:" + dir} {
+		s, err := OpenReadOnly(ctx, spec, db)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if err := s.Put(ctx, "key", strings.NewReader("data"), 4); !errors.Is(err, errReadOnly) {
+			t.Errorf("%s: Put got %v, want errReadOnly", spec, err)
+		}
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master)`).Scan(&exists); err != nil || exists {
+		t.Fatalf("database schema changed: %t, %v", exists, err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("directory created: %v", err)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	const key = "Ag0RV5hV-5cK1zzUDa7hjyVfTx8"
+	data := []byte("hello, world")
+	if _, err := s.Get(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of missing blob: got %v, want fs.ErrNotExist", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Put(ctx, key, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := read(t, s, key); got != string(data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+	r, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Seek(-5, io.SeekEnd); err != nil || n != 7 {
+		t.Fatalf("Seek: %d, %v", n, err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "world" {
+		t.Fatalf("read after seek: %q, %v", b, err)
+	}
+	if err := s.Put(ctx, "../escape", bytes.NewReader(data), int64(len(data))); err == nil {
+		t.Fatal("Put with invalid key did not fail")
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of deleted blob: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func read(t *testing.T, s Store, key string) string {
+	t.Helper()
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible service
+// accessed with path-style requests
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.objects == nil {
+		f.objects = make(map[string][]byte)
+	}
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead, http.MethodGet:
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+			off, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			if err != nil || off > len(b) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			b = b[off:]
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(b)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestS3ObjectSeek(t *testing.T) {
+	o := &s3Object{size: 10}
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{4, io.SeekStart, 4},
+		{2, io.SeekCurrent, 6},
+		{-3, io.SeekEnd, 7},
+	} {
+		if got, err := o.Seek(tc.offset, tc.whence); err != nil || got != tc.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tc.offset, tc.whence, got, err, tc.want)
+		}
+	}
+	if _, err := o.Seek(0, 42); err == nil {
+		t.Fatal("Seek with invalid whence did not fail")
+	}
+	if _, err := o.Seek(-11, io.SeekEnd); err == nil {
+		t.Fatal("Seek to negative position did not fail")
+	}
+}
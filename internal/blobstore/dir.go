@@ -0,0 +1,85 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+type dirStore struct{ dir string }
+
+// NewDir returns Store keeping blobs as files in the directory, spread over
+// subdirectories named after the first two characters of the key
+func NewDir(dir string) (Store, error) {
+	if dir == "" {
+		return nil, errors.New("empty directory name")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &dirStore{dir: dir}, nil
+}
+
+func (s *dirStore) name(key string) (string, error) {
+	if !validKey(key) {
+		return "", fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+	if len(key) < 3 {
+		return filepath.Join(s.dir, key), nil
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+func (s *dirStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(name); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if n, err := io.Copy(f, io.LimitReader(r, size)); err != nil {
+		return err
+	} else if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *dirStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+func (s *dirStore) Delete(ctx context.Context, key string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
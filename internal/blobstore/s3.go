@@ -0,0 +1,173 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type s3Store struct {
+	client         *s3.Client
+	bucket, prefix string
+}
+
+// NewS3 returns Store keeping blobs as objects in the S3 bucket, with object
+// keys made of prefix followed by the blob key
+func NewS3(client *s3.Client, bucket, prefix string) Store {
+	return &s3Store{client: client, bucket: bucket, prefix: prefix}
+}
+
+func openS3(ctx context.Context, u *url.URL) (Store, error) {
+	if u.Host == "" {
+		return nil, errors.New("no S3 bucket name")
+	}
+	q := u.Query()
+	var opts []func(*config.LoadOptions) error
+	if region := q.Get("region"); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint := q.Get("endpoint"); endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+		}
+		o.UsePathStyle = q.Get("path-style") == "true"
+	})
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return NewS3(client, u.Host, prefix), nil
+}
+
+func (s *s3Store) objectKey(key string) (*string, error) {
+	if !validKey(key) {
+		return nil, fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+	k := s.prefix + key
+	return &k, nil
+}
+
+// size returns size of the object, or an error wrapping fs.ErrNotExist
+func (s *s3Store) size(ctx context.Context, objectKey *string) (int64, error) {
+	out, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: &s.bucket, Key: objectKey})
+	if err != nil {
+		var re interface{ HTTPStatusCode() int }
+		if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound {
+			return 0, fmt.Errorf("blob %q: %w", *objectKey, fs.ErrNotExist)
+		}
+		return 0, err
+	}
+	return out.ContentLength, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := s.size(ctx, objectKey); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &s.bucket,
+		Key:           objectKey,
+		Body:          r,
+		ContentLength: size,
+	})
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	size, err := s.size(ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{ctx: ctx, s: s, key: objectKey, size: size}, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: &s.bucket, Key: objectKey})
+	return err
+}
+
+// s3Object reads S3 object with ranged requests, so that seeking does not
+// require downloading the whole object
+type s3Object struct {
+	ctx       context.Context
+	s         *s3Store
+	key       *string
+	size, off int64
+	body      io.ReadCloser // response body starting at off, nil if not requested yet
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		rng := fmt.Sprintf("bytes=%d-", o.off)
+		out, err := o.s.client.GetObject(o.ctx, &s3.GetObjectInput{Bucket: &o.s.bucket, Key: o.key, Range: &rng})
+		if err != nil {
+			return 0, err
+		}
+		o.body = out.Body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
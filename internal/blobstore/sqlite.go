@@ -0,0 +1,152 @@
+package blobstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// sqliteChunkSize is the size of chunks blobs are split into when kept in
+// SQLite, so that reading a part of a blob doesn't load all of it
+const sqliteChunkSize = 1 << 20
+
+type sqliteStore struct {
+	db    *sql.DB
+	chunk int
+}
+
+// NewSQLite returns Store keeping blobs in the blob_chunks table of the
+// database, creating this table if needed.
+func NewSQLite(ctx context.Context, db *sql.DB) (Store, error) {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS blob_chunks(
+		Key TEXT NOT NULL,
+		Start INT NOT NULL, -- offset of the chunk within the blob
+		Bytes BLOB NOT NULL,
+		PRIMARY KEY(Key, Start)
+	)`); err != nil {
+		return nil, err
+	}
+	return &sqliteStore{db: db, chunk: sqliteChunkSize}, nil
+}
+
+func (s *sqliteStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	if !validKey(key) {
+		return fmt.Errorf("%w: %q", errInvalidKey, key)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM blob_chunks WHERE Key=?)`, key).
+		Scan(&exists); err != nil || exists {
+		return err
+	}
+	b := make([]byte, min(size, int64(s.chunk)))
+	var start int64
+	for start == 0 || start < size {
+		n := min(size-start, int64(len(b)))
+		if _, err := io.ReadFull(r, b[:n]); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO blob_chunks(Key,Start,Bytes) VALUES(?,?,?)`,
+			key, start, b[:n]); err != nil {
+			return err
+		}
+		if start += n; n == 0 {
+			break
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	var size int64
+	switch err := s.db.QueryRowContext(ctx, `SELECT Start+length(Bytes) FROM blob_chunks
+		WHERE Key=? ORDER BY Start DESC LIMIT 1`, key).Scan(&size); err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, fmt.Errorf("blob %q: %w", key, fs.ErrNotExist)
+	default:
+		return nil, err
+	}
+	return &sqliteBlob{ctx: ctx, db: s.db, key: key, size: size}, nil
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM blob_chunks WHERE Key=?`, key)
+	return err
+}
+
+func (s *sqliteStore) DeleteTx(ctx context.Context, tx *sql.Tx, key string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM blob_chunks WHERE Key=?`, key)
+	return err
+}
+
+// sqliteBlob reads a blob from the blob_chunks table, loading one chunk at a
+// time
+type sqliteBlob struct {
+	ctx    context.Context
+	db     *sql.DB
+	key    string
+	size   int64
+	off    int64
+	start  int64  // offset of the loaded chunk
+	chunk  []byte // loaded chunk
+	closed bool
+}
+
+func (b *sqliteBlob) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fs.ErrClosed
+	}
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if b.chunk == nil || b.off < b.start || b.off >= b.start+int64(len(b.chunk)) {
+		if err := b.db.QueryRowContext(b.ctx, `SELECT Start, Bytes FROM blob_chunks
+			WHERE Key=? AND Start<=? ORDER BY Start DESC LIMIT 1`, b.key, b.off).Scan(&b.start, &b.chunk); err != nil {
+			b.chunk = nil
+			if err == sql.ErrNoRows {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b.off >= b.start+int64(len(b.chunk)) {
+			b.chunk = nil
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, b.chunk[b.off-b.start:])
+	b.off += int64(n)
+	return n, nil
+}
+
+func (b *sqliteBlob) Seek(offset int64, whence int) (int64, error) {
+	if b.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.off = offset
+	return offset, nil
+}
+
+func (b *sqliteBlob) Close() error {
+	b.closed, b.chunk = true, nil
+	return nil
+}
@@ -0,0 +1,288 @@
+// Package filegc removes uploaded files that notes no longer link to.
+//
+// Files are uploaded to the /.files/{hash}/{name} paths, where hash is the
+// content hash of the file as stored; thumbnails of images share the hash
+// directory of their original. A file is considered referenced as long as any
+// note text mentions its hash directory, so that links to the file under any
+// of its names, and to any of its thumbnails, keep it.
+//
+// Unreferenced files are first marked as such by setting the Orphaned column
+// of the files table, and removed by a later run once they stay unreferenced
+// for longer than the grace period, which gives time to save a note after
+// uploading a file to it. Files of notes in the trash are never removed.
+//
+// Blobs are removed from the storage once none of the files or trash_files
+// rows refer to them; triggers on these tables record hashes of deleted rows
+// in the orphan_blobs table for that. Each blob is removed within a database
+// transaction holding the write lock, after checking that it's still unused.
+// Uploads check that the blob exists after adding a files row in their
+// transaction, so they either see the blob removed and store it again, or
+// keep the blob from being removed.
+package filegc
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+)
+
+// Options control the Run behavior
+type Options struct {
+	// Grace is how long files must stay unreferenced before they're
+	// removed. Zero removes unreferenced files right away.
+	Grace time.Duration
+	// DryRun reports what would be removed without changing anything
+	DryRun bool
+}
+
+// File describes an unreferenced uploaded file
+type File struct {
+	Path     string
+	Notes    []string // paths of notes the file was uploaded to
+	Size     int64    // total size of the file and its thumbnails
+	Orphaned time.Time
+	Removed  bool // whether the file was removed (or would be, on a dry run)
+}
+
+// Report describes results of a Run
+type Report struct {
+	Files []File // unreferenced files, thumbnails are not listed separately
+	Blobs int    // number of blobs removed (or to be removed) from the storage
+}
+
+// Run finds uploaded files no note links to and removes the ones that stay
+// unreferenced for longer than the grace period, along with their blobs.
+func Run(ctx context.Context, db *sql.DB, blobs blobstore.Store, opts Options) (*Report, error) {
+	now := time.Now()
+	refs, err := referencedDirs(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT Path, Hash, Size, Original, Orphaned,
+		(SELECT json_group_array(NotePath) FROM note_files WHERE note_files.Path=files.Path)
+		FROM files ORDER BY Original IS NOT NULL, Path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	report := new(Report)
+	var marked, unmarked, removed []string
+	kept := make(map[string]struct{}) // hashes of files that stay
+	removedHashes := make(map[string]struct{})
+	originals := make(map[string]int) // index in report.Files by path
+	for rows.Next() {
+		var f File
+		var hash string
+		var original sql.NullString
+		var ts sql.NullInt64
+		var notes []byte
+		if err := rows.Scan(&f.Path, &hash, &f.Size, &original, &ts, &notes); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(notes, &f.Notes); err != nil {
+			return nil, err
+		}
+		if _, ok := refs[hashDir(f.Path)]; ok {
+			if ts.Valid {
+				unmarked = append(unmarked, f.Path)
+			}
+			kept[hash] = struct{}{}
+			continue
+		}
+		if ts.Valid {
+			f.Orphaned = time.Unix(ts.Int64, 0)
+		} else {
+			f.Orphaned = now
+			marked = append(marked, f.Path)
+		}
+		if f.Removed = !f.Orphaned.After(now.Add(-opts.Grace)); f.Removed {
+			removed = append(removed, f.Path)
+			removedHashes[hash] = struct{}{}
+		} else {
+			kept[hash] = struct{}{}
+		}
+		if original.Valid {
+			if i, ok := originals[original.String]; ok {
+				report.Files[i].Size += f.Size
+			}
+			continue
+		}
+		originals[f.Path] = len(report.Files)
+		report.Files = append(report.Files, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if opts.DryRun {
+		n, err := orphanBlobs(ctx, tx, removedHashes, kept)
+		report.Blobs = len(n)
+		return report, err
+	}
+	for _, s := range [...]struct {
+		query string
+		paths []string
+	}{
+		{`UPDATE files SET Orphaned=NULL WHERE Path=@path`, unmarked},
+		{`UPDATE files SET Orphaned=@now WHERE Path=@path`, marked},
+		{`DELETE FROM files WHERE Path=@path`, removed},
+	} {
+		for _, p := range s.paths {
+			if _, err := tx.ExecContext(ctx, s.query, sql.Named("path", p), sql.Named("now", now.Unix())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	hashes, err := orphanBlobs(ctx, tx, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		ok, err := removeBlob(ctx, db, blobs, hash)
+		if err != nil {
+			return report, fmt.Errorf("removing blob %q: %w", hash, err)
+		}
+		if ok {
+			report.Blobs++
+		}
+	}
+	return report, nil
+}
+
+// removeBlob removes the blob from the storage unless a file uses it again,
+// and reports whether it was removed
+func removeBlob(ctx context.Context, db *sql.DB, blobs blobstore.Store, hash string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// writing first takes the write lock, so that no file using the blob
+	// can be added until the transaction ends
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orphan_blobs WHERE Hash=@hash`, sql.Named("hash", hash)); err != nil {
+		return false, err
+	}
+	var used bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE Hash=@hash)
+		OR EXISTS(SELECT 1 FROM trash_files WHERE Hash=@hash)`, sql.Named("hash", hash)).Scan(&used); err != nil {
+		return false, err
+	}
+	if used {
+		return false, tx.Commit()
+	}
+	if d, ok := blobs.(blobstore.TxDeleter); ok {
+		err = d.DeleteTx(ctx, tx, hash)
+	} else {
+		err = blobs.Delete(ctx, hash)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// orphanBlobs returns hashes recorded in the orphan_blobs table that no file
+// uses, and drops the ones still in use from that table. Hashes in extra are
+// considered recorded as well, and ones in kept used, which allows a dry run
+// to tell which blobs would be removed.
+func orphanBlobs(ctx context.Context, tx *sql.Tx, extra, kept map[string]struct{}) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT Hash FROM orphan_blobs`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	candidates := make(map[string]struct{})
+	for h := range extra {
+		candidates[h] = struct{}{}
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		candidates[hash] = struct{}{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	var out []string
+	for hash := range candidates {
+		var used bool
+		if _, ok := kept[hash]; ok {
+			used = true
+		} else if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM trash_files WHERE Hash=@hash)
+			OR (@all AND EXISTS(SELECT 1 FROM files WHERE Hash=@hash))`,
+			sql.Named("hash", hash), sql.Named("all", kept == nil)).Scan(&used); err != nil {
+			return nil, err
+		}
+		if !used {
+			out = append(out, hash)
+			continue
+		}
+		if kept == nil {
+			// recorded again once rows using it are deleted
+			if _, err := tx.ExecContext(ctx, `DELETE FROM orphan_blobs WHERE Hash=@hash`, sql.Named("hash", hash)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// referencedDirs returns hash directories of uploaded files mentioned in the
+// notes text
+func referencedDirs(ctx context.Context, db *sql.DB) (map[string]struct{}, error) {
+	rows, err := db.QueryContext(ctx, `SELECT Text FROM notes WHERE Text LIKE '%.files/%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make(map[string]struct{})
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			return nil, err
+		}
+		for _, dir := range References(text) {
+			out[dir] = struct{}{}
+		}
+	}
+	return out, rows.Err()
+}
+
+// References returns hash directories of uploaded files mentioned in text
+func References(text string) []string {
+	var out []string
+	for _, m := range refRe.FindAllStringSubmatch(text, -1) {
+		out = append(out, m[1])
+	}
+	return out
+}
+
+var refRe = regexp.MustCompile(`\.files/([A-Za-z0-9_-]{27})/`)
+
+// hashDir returns the hash directory of the uploaded file at path p
+func hashDir(p string) string {
+	p = strings.TrimPrefix(p, ".files/")
+	dir, _, _ := strings.Cut(p, "/")
+	return dir
+}
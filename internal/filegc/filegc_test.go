@@ -0,0 +1,193 @@
+package filegc
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+	_ "modernc.org/sqlite"
+)
+
+func TestReferences(t *testing.T) {
+	text := `![a](/.files/AAAAAAAAAAAAAAAAAAAAAAAAAAA/a.png)
+<img src="/.files/BBBBBBBBBBBBBBBBBBBBBBBBBBB/320w/b.jpg">
+[relative](.files/CCCCCCCCCCCCCCCCCCCCCCCCCCC/c.txt) /.files/short/d.txt`
+	got := strings.Join(References(text), " ")
+	want := "AAAAAAAAAAAAAAAAAAAAAAAAAAA BBBBBBBBBBBBBBBBBBBBBBBBBBB CCCCCCCCCCCCCCCCCCCCCCCCCCC"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, s := range [...]string{
+		`CREATE TABLE notes(Path TEXT PRIMARY KEY, Text TEXT)`,
+		`CREATE TABLE files(Path TEXT PRIMARY KEY, Hash TEXT, Size INT, Original TEXT, Orphaned INT)`,
+		`CREATE TABLE note_files(NotePath TEXT, Path TEXT)`,
+		`CREATE TABLE trash_files(Path TEXT, Hash TEXT)`,
+		`CREATE TABLE orphan_blobs(Hash TEXT PRIMARY KEY)`,
+		`CREATE TRIGGER files_ad AFTER DELETE ON files BEGIN
+			INSERT OR IGNORE INTO orphan_blobs(Hash) VALUES(old.Hash);
+		END`,
+		`INSERT INTO notes VALUES('a', '![](/.files/KeptKeptKeptKeptKeptKeptKep/640w/kept.jpg)')`,
+		`INSERT INTO notes VALUES('b', 'no links')`,
+		`INSERT INTO files(Path,Hash,Size,Original) VALUES
+			('.files/KeptKeptKeptKeptKeptKeptKep/kept.jpg', 'KeptKeptKeptKeptKeptKeptKep', 10, NULL),
+			('.files/KeptKeptKeptKeptKeptKeptKep/640w/kept.jpg', 'thumb1', 1, '.files/KeptKeptKeptKeptKeptKeptKep/kept.jpg'),
+			('.files/GoneGoneGoneGoneGoneGoneGon/gone.jpg', 'GoneGoneGoneGoneGoneGoneGon', 20, NULL),
+			('.files/GoneGoneGoneGoneGoneGoneGon/640w/gone.jpg', 'thumb2', 2, '.files/GoneGoneGoneGoneGoneGoneGon/gone.jpg'),
+			('.files/SameSameSameSameSameSameSam/same.txt', 'shared', 5, NULL)`,
+		`INSERT INTO note_files VALUES
+			('a', '.files/KeptKeptKeptKeptKeptKeptKep/kept.jpg'),
+			('a', '.files/GoneGoneGoneGoneGoneGoneGon/gone.jpg'),
+			('b', '.files/GoneGoneGoneGoneGoneGoneGon/gone.jpg'),
+			('b', '.files/SameSameSameSameSameSameSam/same.txt')`,
+		`INSERT INTO trash_files VALUES('.files/InTrash/same.txt', 'shared')`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs, err := blobstore.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [...]string{"KeptKeptKeptKeptKeptKeptKep", "thumb1", "GoneGoneGoneGoneGoneGoneGon", "thumb2", "shared"} {
+		if err := blobs.Put(ctx, key, bytes.NewReader([]byte(key)), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary := func(r *Report) string {
+		var ss []string
+		for _, f := range r.Files {
+			s := f.Path + " " + strings.Join(f.Notes, ",")
+			if f.Removed {
+				s += " removed"
+			}
+			ss = append(ss, s)
+		}
+		return strings.Join(ss, "; ")
+	}
+
+	// the first run with a grace period only marks unreferenced files
+	report, err := Run(ctx, db, blobs, Options{Grace: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const unreferenced = ".files/GoneGoneGoneGoneGoneGoneGon/gone.jpg a,b; .files/SameSameSameSameSameSameSam/same.txt b"
+	if got := summary(report); got != unreferenced {
+		t.Fatalf("first run reported %q, want %q", got, unreferenced)
+	}
+	if report.Files[0].Size != 22 || report.Blobs != 0 {
+		t.Fatalf("first run reported size %d, %d blobs", report.Files[0].Size, report.Blobs)
+	}
+	var marked int
+	if err := db.QueryRow(`SELECT count(*) FROM files WHERE Orphaned IS NOT NULL`).Scan(&marked); err != nil || marked != 3 {
+		t.Fatalf("marked %d files (%v), want 3", marked, err)
+	}
+
+	// a dry run without the grace period tells what would be removed
+	report, err = Run(ctx, db, blobs, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const removed = ".files/GoneGoneGoneGoneGoneGoneGon/gone.jpg a,b removed; .files/SameSameSameSameSameSameSam/same.txt b removed"
+	if got := summary(report); got != removed || report.Blobs != 2 {
+		t.Fatalf("dry run reported %q and %d blobs, want %q and 2", got, report.Blobs, removed)
+	}
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM files`).Scan(&count); err != nil || count != 5 {
+		t.Fatalf("dry run left %d files (%v), want 5", count, err)
+	}
+
+	report, err = Run(ctx, db, blobs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summary(report); got != removed || report.Blobs != 2 {
+		t.Fatalf("run reported %q and %d blobs, want %q and 2", got, report.Blobs, removed)
+	}
+	if err := db.QueryRow(`SELECT count(*) FROM files`).Scan(&count); err != nil || count != 2 {
+		t.Fatalf("run left %d files (%v), want 2", count, err)
+	}
+	for key, want := range map[string]bool{
+		"KeptKeptKeptKeptKeptKeptKep": true,
+		"thumb1":                      true,
+		"GoneGoneGoneGoneGoneGoneGon": false,
+		"thumb2":                      false,
+		"shared":                      true, // still used by a note in the trash
+	} {
+		r, err := blobs.Get(ctx, key)
+		if err == nil {
+			r.Close()
+		}
+		if got := !errors.Is(err, fs.ErrNotExist); got != want {
+			t.Errorf("blob %q exists: %t, want %t (%v)", key, got, want, err)
+		}
+	}
+	if err := db.QueryRow(`SELECT count(*) FROM orphan_blobs`).Scan(&count); err != nil || count != 0 {
+		t.Fatalf("%d hashes left in orphan_blobs (%v), want 0", count, err)
+	}
+}
+
+func Test_removeBlob(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// with a single connection, the blob can only be removed within the
+	// transaction
+	db.SetMaxOpenConns(1)
+	for _, s := range [...]string{
+		`CREATE TABLE files(Path TEXT PRIMARY KEY, Hash TEXT)`,
+		`CREATE TABLE trash_files(Path TEXT, Hash TEXT)`,
+		`CREATE TABLE orphan_blobs(Hash TEXT PRIMARY KEY)`,
+		`INSERT INTO orphan_blobs VALUES('reused'), ('unused')`,
+		// uploaded again after the orphan was recorded
+		`INSERT INTO files VALUES('.files/reused/a.txt', 'reused')`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [...]string{"reused", "unused"} {
+		if err := blobs.Put(ctx, key, bytes.NewReader([]byte(key)), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, want := range map[string]bool{"reused": false, "unused": true} {
+		removed, err := removeBlob(ctx, db, blobs, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != want {
+			t.Errorf("blob %q removed: %t, want %t", key, removed, want)
+		}
+		r, err := blobs.Get(ctx, key)
+		if err == nil {
+			r.Close()
+		}
+		if exists := !errors.Is(err, fs.ErrNotExist); exists == want {
+			t.Errorf("blob %q exists: %t (%v)", key, exists, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Package imagemeta removes metadata like EXIF, XMP and IPTC from JPEG and PNG
+// images, so that uploaded photos don't leak location or camera details.
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// ErrFormat is returned for data which is neither JPEG nor PNG image, or
+// which is malformed
+var ErrFormat = errors.New("unsupported or malformed image")
+
+// ErrTooLarge is returned by Clean for images that need to be re-encoded but
+// have more than MaxPixels pixels
+var ErrTooLarge = errors.New("image is too large to process")
+
+// MaxPixels is the largest number of pixels of images that are decoded, which
+// takes at least 4 bytes of memory per pixel
+const MaxPixels = 50_000_000
+
+// Clean copies JPEG or PNG image from r to w without metadata. If the image
+// has EXIF orientation other than the default one, it is applied to the pixels
+// and the image is re-encoded, so it is displayed upright without the
+// metadata. ICC color profiles of JPEG images are kept. Data following the end
+// of the image, like extra images some phones append, is dropped.
+func Clean(w io.Writer, r io.ReadSeeker) error {
+	format, icc, orientation, err := strip(io.Discard, r)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if orientation <= 1 || orientation > 8 {
+		_, _, _, err := strip(w, r)
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return ErrFormat
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return ErrFormat
+	}
+	if format == "png" {
+		return png.Encode(w, Orient(img, orientation))
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, Orient(img, orientation), &jpeg.Options{Quality: 90}); err != nil {
+		return err
+	}
+	_, err = w.Write(insertSegments(buf.Bytes(), icc))
+	return err
+}
+
+// Orientation returns EXIF orientation of JPEG or PNG image, or 0 if there's
+// none. Data may be truncated as long as it includes the metadata.
+func Orientation(data []byte) int {
+	_, _, orientation, _ := strip(io.Discard, bytes.NewReader(data))
+	return orientation
+}
+
+var (
+	jpegSOI      = []byte{0xff, 0xd8}
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	exifPrefix   = []byte("Exif\x00\x00")
+	iccPrefix    = []byte("ICC_PROFILE\x00")
+)
+
+// strip copies JPEG or PNG image from r to w without metadata, returning the
+// image format, ICC profile segments of JPEG images, and EXIF orientation, 0
+// if there's none. The orientation found is returned on errors too.
+func strip(w io.Writer, r io.Reader) (format string, icc [][]byte, orientation int, err error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	head, _ := br.Peek(len(pngSignature))
+	switch {
+	case bytes.HasPrefix(head, jpegSOI):
+		format = "jpeg"
+		icc, orientation, err = stripJPEG(bw, br)
+	case bytes.HasPrefix(head, pngSignature):
+		format = "png"
+		orientation, err = stripPNG(bw, br)
+	default:
+		return "", nil, 0, ErrFormat
+	}
+	if err != nil {
+		return "", nil, orientation, err
+	}
+	return format, icc, orientation, bw.Flush()
+}
+
+// readErr turns errors of reading truncated data into ErrFormat
+func readErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrFormat
+	}
+	return err
+}
+
+// JPEG markers
+const (
+	markerAPP1 = 0xe1 // EXIF, XMP
+	markerAPP2 = 0xe2 // ICC profile, FlashPix, MPF
+	markerAPPD = 0xed // IPTC
+	markerSOS  = 0xda
+	markerEOI  = 0xd9
+	markerCOM  = 0xfe
+)
+
+// stripJPEG copies JPEG data without APP1, APP13 and COM segments, and APP2
+// segments other than ICC profile ones, stopping at the end of image marker.
+// It returns ICC profile segments and EXIF orientation, 0 if there's none.
+func stripJPEG(w *bufio.Writer, r *bufio.Reader) (icc [][]byte, orientation int, err error) {
+	if _, err := r.Discard(len(jpegSOI)); err != nil {
+		return nil, 0, readErr(err)
+	}
+	w.Write(jpegSOI)
+	var marker byte
+	var scanEnd bool // marker was read at the end of entropy-coded data
+	for {
+		if !scanEnd {
+			if marker, err = readMarker(r); err != nil {
+				return nil, orientation, err
+			}
+		}
+		scanEnd = false
+		switch {
+		case marker == markerEOI:
+			w.Write([]byte{0xff, marker})
+			return icc, orientation, nil
+		case marker >= 0xd0 && marker <= 0xd7 || marker == 0x01:
+			w.Write([]byte{0xff, marker})
+			continue
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return nil, orientation, readErr(err)
+		}
+		n := int(binary.BigEndian.Uint16(size[:]))
+		if n < 2 {
+			return nil, orientation, ErrFormat
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, orientation, readErr(err)
+		}
+		switch marker {
+		case markerAPP1:
+			if bytes.HasPrefix(payload, exifPrefix) && orientation == 0 {
+				orientation = exifOrientation(payload[len(exifPrefix):])
+			}
+			continue
+		case markerAPPD, markerCOM:
+			continue
+		case markerAPP2:
+			if !bytes.HasPrefix(payload, iccPrefix) {
+				continue
+			}
+			icc = append(icc, append([]byte{0xff, marker, size[0], size[1]}, payload...))
+		}
+		w.Write([]byte{0xff, marker})
+		w.Write(size[:])
+		w.Write(payload)
+		if marker == markerSOS {
+			if marker, err = copyScan(w, r); err != nil {
+				return nil, orientation, err
+			}
+			scanEnd = true
+		}
+	}
+}
+
+// readMarker reads JPEG marker, which may be preceded by any number of fill
+// bytes
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, readErr(err)
+	}
+	if b != 0xff {
+		return 0, ErrFormat
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, readErr(err)
+		}
+	}
+	if b == 0 {
+		return 0, ErrFormat
+	}
+	return b, nil
+}
+
+// copyScan copies entropy-coded data following the SOS segment, and returns
+// the marker ending it. Within this data, 0xff bytes are followed either by
+// zero bytes or by restart markers.
+func copyScan(w *bufio.Writer, r *bufio.Reader) (byte, error) {
+	for {
+		chunk, err := r.ReadSlice(0xff)
+		switch err {
+		case nil:
+		case bufio.ErrBufferFull:
+			w.Write(chunk)
+			continue
+		default:
+			return 0, readErr(err)
+		}
+		w.Write(chunk[:len(chunk)-1])
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xff {
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, readErr(err)
+		}
+		if marker != 0 && (marker < 0xd0 || marker > 0xd7) {
+			return marker, nil
+		}
+		w.Write([]byte{0xff, marker})
+	}
+}
+
+// insertSegments inserts segments right after the JFIF header of JPEG data
+// produced by image/jpeg
+func insertSegments(data []byte, segments [][]byte) []byte {
+	if len(segments) == 0 {
+		return data
+	}
+	pos := len(jpegSOI)
+	// skip APP0 segment, if any
+	if len(data) > pos+4 && data[pos] == 0xff && data[pos+1] == 0xe0 {
+		pos += 2 + int(binary.BigEndian.Uint16(data[pos+2:]))
+	}
+	out := make([]byte, 0, len(data)+len(segments)*len(segments[0]))
+	out = append(out, data[:pos]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, data[pos:]...)
+}
+
+// maxEXIF is the size of the largest eXIf chunk of PNG images looked into for
+// orientation
+const maxEXIF = 1 << 20
+
+// stripPNG copies PNG data without eXIf, text and tIME chunks, stopping at the
+// IEND chunk, and returns the EXIF orientation, 0 if there's none
+func stripPNG(w *bufio.Writer, r *bufio.Reader) (orientation int, err error) {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return 0, readErr(err)
+	}
+	w.Write(pngSignature)
+	var hdr [8]byte // chunk length and type
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return orientation, readErr(err)
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:])) + 4 // chunk data and CRC
+		switch typ := string(hdr[4:]); typ {
+		case "eXIf":
+			if orientation == 0 && n <= maxEXIF {
+				data := make([]byte, n)
+				if _, err := io.ReadFull(r, data); err != nil {
+					return orientation, readErr(err)
+				}
+				orientation = exifOrientation(data[:n-4])
+				continue
+			}
+			fallthrough
+		case "tEXt", "zTXt", "iTXt", "tIME":
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return orientation, readErr(err)
+			}
+			continue
+		case "IEND":
+			w.Write(hdr[:])
+			_, err := io.CopyN(w, r, n)
+			return orientation, readErr(err)
+		}
+		w.Write(hdr[:])
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return orientation, readErr(err)
+		}
+	}
+}
+
+// exifOrientation returns value of the orientation tag from the IFD0 of EXIF
+// data, or 0 if there's none
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := order.Uint32(tiff[4:])
+	if offset < 8 || uint64(offset)+2 > uint64(len(tiff)) {
+		return 0
+	}
+	ifd := tiff[offset:]
+	count := int(order.Uint16(ifd))
+	ifd = ifd[2:]
+	const tagOrientation, typeShort = 0x0112, 3
+	for i := 0; i < count && len(ifd) >= 12; i++ {
+		entry := ifd[:12]
+		ifd = ifd[12:]
+		if order.Uint16(entry) == tagOrientation && order.Uint16(entry[2:]) == typeShort {
+			return int(order.Uint16(entry[8:]))
+		}
+	}
+	return 0
+}
+
+// Orient returns img transformed according to the EXIF orientation value, so
+// that it is displayed upright
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if orientation >= 5 {
+		dw, dh = sh, sw
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sx, sy = sw-1-x, y
+			case 3: // rotated 180°
+				sx, sy = sw-1-x, sh-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, sh-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90° clockwise rotation
+				sx, sy = y, sh-1-x
+			case 7: // transversed
+				sx, sy = sw-1-y, sh-1-x
+			case 8: // needs 90° counter-clockwise rotation
+				sx, sy = sw-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,154 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestCleanPNG(t *testing.T) {
+	// 3×2 image with a distinct top-left pixel
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// put metadata chunks right after IHDR
+	ihdrEnd := len(pngSignature) + 12 + 13
+	var withMeta []byte
+	withMeta = append(withMeta, data[:ihdrEnd]...)
+	withMeta = append(withMeta, pngChunk("eXIf", exifData(6))...)
+	withMeta = append(withMeta, pngChunk("tEXt", []byte("GPS\x0051.5,-0.1"))...)
+	withMeta = append(withMeta, data[ihdrEnd:]...)
+
+	out, err := clean(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("eXIf")) || bytes.Contains(out, []byte("GPS")) {
+		t.Fatal("metadata not removed")
+	}
+	got, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := got.Bounds(); b.Dx() != 2 || b.Dy() != 3 {
+		t.Fatalf("got %v image, want 2×3", b)
+	}
+	// rotated clockwise, top-left pixel becomes top-right
+	if r, _, _, _ := got.At(1, 0).RGBA(); r != 0xffff {
+		t.Fatalf("red pixel not found at the top-right corner")
+	}
+}
+
+func TestCleanJPEG(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	icc := jpegSegment(markerAPP2, append(append([]byte{}, iccPrefix...), 1, 1, 'p', 'r', 'o', 'f'))
+	var withMeta []byte
+	withMeta = append(withMeta, jpegSOI...)
+	withMeta = append(withMeta, jpegSegment(markerAPP1, append(append([]byte{}, exifPrefix...), exifData(1)...))...)
+	withMeta = append(withMeta, icc...)
+	withMeta = append(withMeta, jpegSegment(markerAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))...)
+	withMeta = append(withMeta, jpegSegment(markerCOM, []byte("camera serial 123"))...)
+	withMeta = append(withMeta, jpegSegment(markerAPP2, []byte("MPF\x00secondary image index"))...)
+	withMeta = append(withMeta, data[len(jpegSOI):]...)
+	// trailer with another image and its own EXIF, as some phones add
+	withMeta = append(withMeta, jpegSOI...)
+	withMeta = append(withMeta, jpegSegment(markerAPP1, append(append([]byte{}, exifPrefix...), "GPS"...))...)
+
+	out, err := clean(withMeta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(out, []byte{0xff, markerEOI}) {
+		t.Error("data after the end of image not removed")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("decoding cleaned image: %v", err)
+	}
+	for _, s := range []string{"Exif", "xmpmeta", "serial", "MPF", "GPS"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q not removed", s)
+		}
+	}
+	if !bytes.Contains(out, icc) {
+		t.Error("ICC profile not kept")
+	}
+	if want := append(append([]byte{}, jpegSOI...), icc...); !bytes.HasPrefix(out, want) {
+		t.Error("unexpected output prefix")
+	}
+
+	withMeta = append(jpegSOI[:2:2], jpegSegment(markerAPP1, append(append([]byte{}, exifPrefix...), exifData(8)...))...)
+	withMeta = append(withMeta, icc...)
+	withMeta = append(withMeta, data[len(jpegSOI):]...)
+	if out, err = clean(withMeta); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 8 || cfg.Height != 16 {
+		t.Fatalf("got %d×%d image, want 8×16", cfg.Width, cfg.Height)
+	}
+	if !bytes.Contains(out, icc) {
+		t.Error("ICC profile not kept after re-encoding")
+	}
+	if _, err := clean([]byte("GIF89a")); err != ErrFormat {
+		t.Fatalf("got %v, want ErrFormat", err)
+	}
+	if _, err := clean(withMeta[:len(withMeta)/2]); err != ErrFormat {
+		t.Fatalf("truncated image: got %v, want ErrFormat", err)
+	}
+
+	// image/jpeg writes dimensions to the SOF0 segment as height and width
+	sof := bytes.Index(withMeta, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(withMeta[sof+5:], 10000)
+	binary.BigEndian.PutUint16(withMeta[sof+7:], 10000)
+	if _, err := clean(withMeta); err != ErrTooLarge {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func clean(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := Clean(buf, bytes.NewReader(data))
+	return buf.Bytes(), err
+}
+
+// exifData returns big-endian TIFF data with a single orientation tag
+func exifData(orientation uint16) []byte {
+	b := []byte("MM\x00*\x00\x00\x00\x08")
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, 0x0112)
+	b = binary.BigEndian.AppendUint16(b, 3)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, orientation)
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	return b
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, typ...)
+	b = append(b, data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	b := []byte{0xff, marker}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
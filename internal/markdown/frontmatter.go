@@ -0,0 +1,57 @@
+package markdown
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SplitFrontMatter splits text into the YAML front matter and the rest of the
+// text. Front matter must start on the very first line of text with the "---"
+// line and end with the "---" or "..." line. If text has no front matter, ok
+// is false and body is the whole text.
+func SplitFrontMatter(text []byte) (front, body []byte, ok bool) {
+	rest, found := cutLine(text, "---")
+	if !found {
+		return nil, text, false
+	}
+	for off := 0; off < len(rest); {
+		line := rest[off:]
+		if i := bytes.IndexByte(line, '\n'); i != -1 {
+			line = line[:i+1]
+		}
+		if s := bytes.TrimRight(line, " \t\r\n"); string(s) == "---" || string(s) == "..." {
+			return rest[:off], rest[off+len(line):], true
+		}
+		off += len(line)
+	}
+	return nil, text, false
+}
+
+// cutLine returns text after its first line if this line is equal to s,
+// ignoring trailing whitespace
+func cutLine(text []byte, s string) (rest []byte, found bool) {
+	line, rest, ok := bytes.Cut(text, []byte("\n"))
+	if !ok || string(bytes.TrimRight(line, " \t\r")) != s {
+		return nil, false
+	}
+	return rest, true
+}
+
+// FrontMatter returns metadata from the YAML front matter of text along with
+// the text without it. If text has no front matter, or it is not a YAML
+// mapping, FrontMatter returns nil metadata and the whole text.
+func FrontMatter(text []byte) (map[string]any, []byte) {
+	front, body, ok := SplitFrontMatter(text)
+	if !ok {
+		return nil, text
+	}
+	var meta map[string]any
+	if err := yaml.Unmarshal(front, &meta); err != nil {
+		return nil, text
+	}
+	if meta == nil {
+		meta = make(map[string]any)
+	}
+	return meta, body
+}
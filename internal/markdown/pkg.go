@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/ast"
@@ -16,7 +20,7 @@ import (
 
 var Markdown = goldmark.New(
 	goldmark.WithRendererOptions(html.WithUnsafe()),
-	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithExtensions(extension.GFM, wikiLinks{}),
 	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
 )
 
@@ -162,3 +166,80 @@ func FirstParagraphText(body []byte, doc ast.Node) string {
 	_ = ast.Walk(doc, fn)
 	return strings.TrimSpace(text)
 }
+
+// LocalLink describes a link to another note
+type LocalLink struct {
+	Path    string // note path, without the leading slash
+	Context string // plain text of the block holding the link
+}
+
+// LocalLinks returns links to other notes found in a document of the note at
+// the base path. Both regular links and wiki links are considered; regular
+// links are considered local if they have neither scheme nor host, and point
+// outside of the special paths starting with a dot. Links are deduplicated by
+// their paths, links to the base note itself are skipped.
+func LocalLinks(body []byte, doc ast.Node, base string) []LocalLink {
+	var out []LocalLink
+	seen := map[string]struct{}{base: {}}
+	add := func(n ast.Node, p string) {
+		if p == "" || p == "." || strings.HasPrefix(p, ".") || !fs.ValidPath(p) {
+			return
+		}
+		if _, ok := seen[p]; ok {
+			return
+		}
+		seen[p] = struct{}{}
+		block := n.Parent()
+		for block != nil && block.Type() != ast.TypeBlock {
+			block = block.Parent()
+		}
+		var context string
+		if block != nil {
+			context = truncateText(nodeText(block, body), 200)
+		}
+		out = append(out, LocalLink{Path: p, Context: context})
+	}
+	fn := func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch l := n.(type) {
+		case *WikiLink:
+			add(n, l.Path())
+			return ast.WalkSkipChildren, nil
+		case *ast.Link:
+			u, err := url.Parse(string(l.Destination))
+			if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+				return ast.WalkContinue, nil
+			}
+			p := u.Path
+			if !strings.HasPrefix(p, "/") {
+				p = path.Join(path.Dir("/"+base), p)
+			}
+			add(n, path.Clean(p)[1:])
+		}
+		return ast.WalkContinue, nil
+	}
+	_ = ast.Walk(doc, fn)
+	return out
+}
+
+// truncateText shortens text to at most max runes, cutting it on a word
+// boundary if possible
+func truncateText(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	var n int
+	for i := range text {
+		if n == max {
+			text = text[:i]
+			break
+		}
+		n++
+	}
+	if i := strings.LastIndexByte(text, ' '); i > len(text)/2 {
+		text = text[:i]
+	}
+	return text + "…"
+}
@@ -1,6 +1,7 @@
 package markdown
 
 import (
+	"strings"
 	"testing"
 
 	gtext "github.com/yuin/goldmark/text"
@@ -136,3 +137,67 @@ Text.
 		want: "",
 	},
 }
+
+func TestWikiLinks(t *testing.T) {
+	const input = `See [[projects/foo]], [[bar#usage|the bar]] and [regular](/baz).`
+	body := []byte(input)
+	doc := Markdown.Parser().Parse(gtext.NewReader(body))
+	if err := ResolveWikiLinks(doc, pageSet{"projects/foo": {}}); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := Markdown.Renderer().Render(&buf, body, doc); err != nil {
+		t.Fatal(err)
+	}
+	const want = `<p>See <a href="/projects/foo" class="wikilink">projects/foo</a>, ` +
+		`<a href="/bar?edit" class="wikilink-missing" title="Create this page">the bar</a> ` +
+		`and <a href="/baz">regular</a>.</p>` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+type pageSet map[string]struct{}
+
+func (s pageSet) PageExists(p string) (bool, error) { _, ok := s[p]; return ok, nil }
+
+func TestLocalLinks(t *testing.T) {
+	const input = `# Title
+
+See [[projects/foo]], [sibling](bar) and [parent](../baz#section).
+
+External [links](https://example.org/), [attachments](/.files/x/y.png)
+and [self](/notes/page) are skipped, as well as the [[projects/foo|repeated]] ones.
+`
+	body := []byte(input)
+	doc := Markdown.Parser().Parse(gtext.NewReader(body))
+	got := LocalLinks(body, doc, "notes/page")
+	const context = `See projects/foo, sibling and parent.`
+	want := []LocalLink{
+		{Path: "projects/foo", Context: context},
+		{Path: "notes/bar", Context: context},
+		{Path: "baz", Context: context},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	for _, tc := range []struct {
+		input, body string
+		meta        bool
+	}{
+		{"---\ntitle: Note\ntags: [a, b]\n---\n# Body\n", "# Body\n", true},
+		{"---\ntitle: Note\n...\nBody", "Body", true},
+		{"---\n---\nBody", "Body", true},
+		{"---\nnot a mapping\n---\nBody", "---\nnot a mapping\n---\nBody", false},
+		{"---\ntitle: unterminated\n", "---\ntitle: unterminated\n", false},
+		{"# Title\n---\ntitle: x\n---\n", "# Title\n---\ntitle: x\n---\n", false},
+	} {
+		meta, body := FrontMatter([]byte(tc.input))
+		if string(body) != tc.body || (meta != nil) != tc.meta {
+			t.Errorf("FrontMatter(%q) returned body %q, meta %v", tc.input, body, meta)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package markdown
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// KindWikiLink is a NodeKind of the WikiLink node
+var KindWikiLink = ast.NewNodeKind("WikiLink")
+
+// WikiLink is an inline node for the [[path]] and [[path|label]] links to
+// other notes. Its children hold the link label.
+type WikiLink struct {
+	ast.BaseInline
+	// Target is the link target as written in the source: a note path,
+	// optionally followed by the #fragment
+	Target []byte
+	// Missing is set by ResolveWikiLinks if the target note does not exist
+	Missing bool
+}
+
+func (n *WikiLink) Kind() ast.NodeKind { return KindWikiLink }
+
+func (n *WikiLink) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{
+		"Target":  string(n.Target),
+		"Missing": strconv.FormatBool(n.Missing),
+	}, nil)
+}
+
+// Path returns the note path the link points to
+func (n *WikiLink) Path() string {
+	p, _ := splitWikiTarget(string(n.Target))
+	return p
+}
+
+// URL returns the link destination: a note page, or its editor if the note is
+// missing
+func (n *WikiLink) URL() string {
+	p, fragment := splitWikiTarget(string(n.Target))
+	u := &url.URL{Path: "/" + p, Fragment: fragment}
+	if n.Missing {
+		u.RawQuery, u.Fragment = "edit", ""
+	}
+	return u.String()
+}
+
+func splitWikiTarget(target string) (path, fragment string) {
+	path, fragment, _ = strings.Cut(target, "#")
+	return strings.TrimLeft(strings.TrimSpace(path), "/"), strings.TrimSpace(fragment)
+}
+
+// PageLookup is used by ResolveWikiLinks to find out whether a note exists
+type PageLookup interface {
+	PageExists(path string) (bool, error)
+}
+
+// ResolveWikiLinks walks the document and marks wiki links pointing to
+// non-existent notes as missing.
+func ResolveWikiLinks(doc ast.Node, lookup PageLookup) error {
+	return ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || n.Kind() != KindWikiLink {
+			return ast.WalkContinue, nil
+		}
+		link := n.(*WikiLink)
+		p := link.Path()
+		if p == "" {
+			return ast.WalkSkipChildren, nil
+		}
+		ok, err := lookup.PageExists(p)
+		if err != nil {
+			return ast.WalkStop, err
+		}
+		link.Missing = !ok
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+type wikiLinkParser struct{}
+
+func (wikiLinkParser) Trigger() []byte { return []byte{'['} }
+
+func (wikiLinkParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, segment := block.PeekLine()
+	if !bytes.HasPrefix(line, []byte("[[")) {
+		return nil
+	}
+	end := bytes.Index(line, []byte("]]"))
+	if end == -1 {
+		return nil
+	}
+	inner := line[2:end]
+	if len(bytes.TrimSpace(inner)) == 0 || bytes.ContainsAny(inner, "[]") {
+		return nil
+	}
+	target, labelStart := inner, 2
+	if i := bytes.IndexByte(inner, '|'); i != -1 {
+		target, labelStart = inner[:i], 2+i+1
+	}
+	target = bytes.TrimSpace(target)
+	if len(target) == 0 || labelStart == end {
+		return nil
+	}
+	link := &WikiLink{Target: target}
+	link.AppendChild(link, ast.NewTextSegment(text.NewSegment(segment.Start+labelStart, segment.Start+end)))
+	block.Advance(end + 2)
+	return link
+}
+
+type wikiLinkRenderer struct{}
+
+func (wikiLinkRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(KindWikiLink, renderWikiLink)
+}
+
+func renderWikiLink(w util.BufWriter, source []byte, n ast.Node, entering bool) (ast.WalkStatus, error) {
+	link := n.(*WikiLink)
+	if !entering {
+		w.WriteString("</a>")
+		return ast.WalkContinue, nil
+	}
+	w.WriteString(`<a href="`)
+	w.Write(util.EscapeHTML([]byte(link.URL())))
+	if link.Missing {
+		w.WriteString(`" class="wikilink-missing" title="Create this page">`)
+	} else {
+		w.WriteString(`" class="wikilink">`)
+	}
+	return ast.WalkContinue, nil
+}
+
+// wikiLinks is an extension adding support for the [[path]] and [[path|label]]
+// links
+type wikiLinks struct{}
+
+func (wikiLinks) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithInlineParsers(
+		util.Prioritized(wikiLinkParser{}, 199), // before the regular link parser
+	))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(
+		util.Prioritized(wikiLinkRenderer{}, 500),
+	))
+}
@@ -0,0 +1,79 @@
+// Package plaintext extracts text from files of simple formats, so that
+// uploaded text files, logs, CSV exports and HTML pages can be searched.
+package plaintext
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Indexable reports whether text can be extracted from files of the media
+// type t
+func Indexable(t string) bool {
+	t, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return false
+	}
+	switch t {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-yaml", "application/yaml", "application/toml",
+		"application/x-sh", "application/sql", "application/xhtml+xml":
+		return true
+	}
+	return strings.HasPrefix(t, "text/") || strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml")
+}
+
+// Extract returns the text of the document b of the media type t. Markup is
+// removed from HTML documents, other formats are returned as is. Invalid UTF-8
+// sequences, which may come from other encodings or from a document cut short,
+// are dropped. If b doesn't look like text, Extract returns an empty string.
+func Extract(t string, b []byte) string {
+	if !Indexable(t) || bytes.IndexByte(b, 0) != -1 {
+		return ""
+	}
+	if t, _, _ := mime.ParseMediaType(t); t == "text/html" || t == "application/xhtml+xml" {
+		b = htmlText(b)
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return strings.ToValidUTF8(string(b), "")
+}
+
+// htmlText returns text nodes of the HTML document, skipping scripts and
+// styles, with block elements put on separate lines
+func htmlText(b []byte) []byte {
+	var out bytes.Buffer
+	var skip int // depth of elements whose content is skipped
+	z := html.NewTokenizer(bytes.NewReader(b))
+	for {
+		switch tt := z.Next(); tt {
+		case html.ErrorToken:
+			return bytes.TrimSpace(out.Bytes())
+		case html.TextToken:
+			if skip == 0 {
+				out.Write(z.Text())
+			}
+		case html.StartTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			switch a := atom.Lookup(name); a {
+			case atom.Script, atom.Style, atom.Template, atom.Noscript:
+				if tt == html.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+			case atom.P, atom.Div, atom.Br, atom.Li, atom.Tr, atom.Td, atom.Th, atom.Title,
+				atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Pre, atom.Blockquote:
+				if out.Len() != 0 && out.Bytes()[out.Len()-1] != '\n' {
+					out.WriteByte('\n')
+				}
+			}
+		}
+	}
+}
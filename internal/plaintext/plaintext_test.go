@@ -0,0 +1,24 @@
+package plaintext
+
+import "testing"
+
+func TestExtract(t *testing.T) {
+	for _, tc := range []struct {
+		typ, in, want string
+	}{
+		{"text/plain; charset=utf-8", "hello\nworld", "hello\nworld"},
+		{"text/csv", "a,b\n1,2", "a,b\n1,2"},
+		{"application/json", `{"k":"v"}`, `{"k":"v"}`},
+		{"text/html", `<html><head><title>Page</title><style>p{color:red}</style></head>` +
+			`<body><p>First &amp; <b>bold</b></p><script>alert(1)</script><p>Second</p></body>`,
+			"Page\nFirst & bold\nSecond"},
+		{"text/plain", "cut \xe2\x82", "cut "},
+		{"text/plain", "binary\x00data", ""},
+		{"image/png", "\x89PNG", ""},
+		{"application/octet-stream", "text", ""},
+	} {
+		if got := Extract(tc.typ, []byte(tc.in)); got != tc.want {
+			t.Errorf("Extract(%q, %q) = %q, want %q", tc.typ, tc.in, got, tc.want)
+		}
+	}
+}
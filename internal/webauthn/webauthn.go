@@ -0,0 +1,200 @@
+// Package webauthn verifies passkey registration and login responses of the
+// Web Authentication API for a single-user relying party which doesn't check
+// attestation.
+//
+// Public keys are taken in the SubjectPublicKeyInfo form browsers return from
+// AuthenticatorAttestationResponse.getPublicKey(), together with
+// getAuthenticatorData(), so the CBOR-encoded attestation object is not
+// needed.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrVerify is wrapped by errors returned for responses that failed
+// verification
+var ErrVerify = errors.New("webauthn verification failed")
+
+// Expect holds values a response must match
+type Expect struct {
+	Challenge []byte // challenge sent to the browser
+	Origin    string // origin of the page, like https://notes.example
+	RPID      string // relying party ID, the host name of the origin
+}
+
+// Registration is a response to navigator.credentials.create()
+type Registration struct {
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	PublicKey         []byte // DER-encoded SubjectPublicKeyInfo
+}
+
+// Credential is a verified passkey
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // DER-encoded SubjectPublicKeyInfo
+	SignCount uint32
+}
+
+// VerifyRegistration checks the response to a registration request and
+// returns the new credential
+func VerifyRegistration(e Expect, r Registration) (*Credential, error) {
+	if err := verifyClientData(e, "webauthn.create", r.ClientDataJSON); err != nil {
+		return nil, err
+	}
+	ad, err := parseAuthData(e, r.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.flags&flagAttested == 0 || len(ad.credentialID) == 0 {
+		return nil, fmt.Errorf("%w: no attested credential data", ErrVerify)
+	}
+	if _, err := parsePublicKey(r.PublicKey); err != nil {
+		return nil, err
+	}
+	return &Credential{ID: ad.credentialID, PublicKey: r.PublicKey, SignCount: ad.signCount}, nil
+}
+
+// Assertion is a response to navigator.credentials.get()
+type Assertion struct {
+	ClientDataJSON    []byte
+	AuthenticatorData []byte
+	Signature         []byte
+}
+
+// VerifyAssertion checks the response to a login request against the stored
+// credential, and returns the new signature counter to store. A counter that
+// didn't grow indicates a cloned authenticator and fails verification, unless
+// the authenticator doesn't keep counters at all.
+func VerifyAssertion(e Expect, c Credential, a Assertion) (uint32, error) {
+	if err := verifyClientData(e, "webauthn.get", a.ClientDataJSON); err != nil {
+		return 0, err
+	}
+	ad, err := parseAuthData(e, a.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+	pub, err := parsePublicKey(c.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+	cdHash := sha256.Sum256(a.ClientDataJSON)
+	signed := append(append([]byte(nil), a.AuthenticatorData...), cdHash[:]...)
+	digest := sha256.Sum256(signed)
+	var ok bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], a.Signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, signed, a.Signature)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], a.Signature) == nil
+	}
+	if !ok {
+		return 0, fmt.Errorf("%w: invalid signature", ErrVerify)
+	}
+	if (ad.signCount != 0 || c.SignCount != 0) && ad.signCount <= c.SignCount {
+		return 0, fmt.Errorf("%w: signature counter went from %d to %d", ErrVerify, c.SignCount, ad.signCount)
+	}
+	return ad.signCount, nil
+}
+
+// Challenge returns the challenge the client data was made for, so that the
+// response can be matched with the request
+func Challenge(clientDataJSON []byte) ([]byte, error) {
+	var cd struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return nil, fmt.Errorf("%w: client data: %v", ErrVerify, err)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil {
+		return nil, fmt.Errorf("%w: challenge: %v", ErrVerify, err)
+	}
+	return b, nil
+}
+
+func verifyClientData(e Expect, typ string, b []byte) error {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(b, &cd); err != nil {
+		return fmt.Errorf("%w: client data: %v", ErrVerify, err)
+	}
+	switch {
+	case cd.Type != typ:
+		return fmt.Errorf("%w: client data type is %q, want %q", ErrVerify, cd.Type, typ)
+	case cd.Challenge != base64.RawURLEncoding.EncodeToString(e.Challenge) || len(e.Challenge) == 0:
+		return fmt.Errorf("%w: challenge mismatch", ErrVerify)
+	case cd.Origin != e.Origin:
+		return fmt.Errorf("%w: origin is %q, want %q", ErrVerify, cd.Origin, e.Origin)
+	}
+	return nil
+}
+
+const (
+	flagUserPresent = 1 << 0
+	flagAttested    = 1 << 6
+)
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+}
+
+// parseAuthData parses authenticator data, checking that it is made for the
+// expected relying party and that the user was present
+func parseAuthData(e Expect, b []byte) (*authData, error) {
+	// rpIdHash(32) flags(1) signCount(4) [aaguid(16) credIdLen(2) credId ...]
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrVerify)
+	}
+	rpHash := sha256.Sum256([]byte(e.RPID))
+	if !bytes.Equal(b[:32], rpHash[:]) {
+		return nil, fmt.Errorf("%w: relying party ID mismatch", ErrVerify)
+	}
+	ad := &authData{flags: b[32], signCount: binary.BigEndian.Uint32(b[33:37])}
+	if ad.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrVerify)
+	}
+	if ad.flags&flagAttested != 0 {
+		rest := b[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrVerify)
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		if len(rest) < 18+n {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrVerify)
+		}
+		ad.credentialID = rest[18 : 18+n]
+	}
+	return ad, nil
+}
+
+func parsePublicKey(der []byte) (crypto.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key: %v", ErrVerify, err)
+	}
+	switch pub.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		return pub, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported public key type %T", ErrVerify, pub)
+}
@@ -0,0 +1,101 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRegisterAndLogin(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Expect{Challenge: []byte("challenge1"), Origin: "https://notes.example", RPID: "notes.example"}
+	credID := []byte("credential-id")
+	cred, err := VerifyRegistration(e, Registration{
+		ClientDataJSON:    clientData(t, "webauthn.create", e.Challenge, e.Origin),
+		AuthenticatorData: authenticatorData(e.RPID, flagUserPresent|flagAttested, 0, credID),
+		PublicKey:         pub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cred.ID) != string(credID) {
+		t.Fatalf("got credential ID %q, want %q", cred.ID, credID)
+	}
+
+	e.Challenge = []byte("challenge2")
+	assertion := func(e Expect, count uint32) Assertion {
+		cd := clientData(t, "webauthn.get", e.Challenge, e.Origin)
+		ad := authenticatorData(e.RPID, flagUserPresent, count, nil)
+		cdHash := sha256.Sum256(cd)
+		digest := sha256.Sum256(append(append([]byte(nil), ad...), cdHash[:]...))
+		sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Assertion{ClientDataJSON: cd, AuthenticatorData: ad, Signature: sig}
+	}
+	count, err := VerifyAssertion(e, *cred, assertion(e, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("got counter %d, want 5", count)
+	}
+	cred.SignCount = count
+	if _, err := VerifyAssertion(e, *cred, assertion(e, 5)); !errors.Is(err, ErrVerify) {
+		t.Fatalf("repeated counter: got %v, want verification error", err)
+	}
+	other := e
+	other.Origin = "https://evil.example"
+	if _, err := VerifyAssertion(e, *cred, assertion(other, 6)); !errors.Is(err, ErrVerify) {
+		t.Fatalf("wrong origin: got %v, want verification error", err)
+	}
+	other = e
+	other.Challenge = []byte("old challenge")
+	if _, err := VerifyAssertion(e, *cred, assertion(other, 6)); !errors.Is(err, ErrVerify) {
+		t.Fatalf("wrong challenge: got %v, want verification error", err)
+	}
+	a := assertion(e, 6)
+	a.Signature[len(a.Signature)-1] ^= 1
+	if _, err := VerifyAssertion(e, *cred, a); !errors.Is(err, ErrVerify) {
+		t.Fatalf("bad signature: got %v, want verification error", err)
+	}
+}
+
+func clientData(t *testing.T, typ string, challenge []byte, origin string) []byte {
+	b, err := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func authenticatorData(rpID string, flags byte, count uint32, credID []byte) []byte {
+	h := sha256.Sum256([]byte(rpID))
+	b := append(h[:], flags)
+	b = binary.BigEndian.AppendUint32(b, count)
+	if flags&flagAttested != 0 {
+		b = append(b, make([]byte, 16)...) // AAGUID
+		b = binary.BigEndian.AppendUint16(b, uint16(len(credID)))
+		b = append(b, credID...)
+	}
+	return b
+}
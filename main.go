@@ -5,8 +5,10 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"crypto/sha1"
 	"database/sql"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -15,20 +17,25 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
 	"artyom.dev/zipserver"
 	"github.com/artyom/httpgzip"
+	"github.com/artyom/notes-server/internal/access"
+	"github.com/artyom/notes-server/internal/blobstore"
 	"github.com/artyom/notes-server/internal/markdown"
 	gtext "github.com/yuin/goldmark/text"
 	"golang.org/x/crypto/acme/autocert"
-	"modernc.org/sqlite"
+	_ "modernc.org/sqlite"
 )
 
 func main() {
@@ -43,6 +50,31 @@ func main() {
 	flag.StringVar(&args.database, "db", args.database, "`path` to the database")
 	flag.StringVar(&args.collapsedTags, "tags", args.collapsedTags, "comma-separated `list` of tags that"+
 		" should be collapsed in the index view")
+	flag.DurationVar(&args.trashRetention, "trash", 30*24*time.Hour, "how long to keep deleted notes in the trash"+
+		" before removing them permanently; 0 keeps them forever")
+	flag.StringVar(&args.blobs, "blobs", "sqlite", "`storage` for uploaded files: sqlite, dir:/path/to/dir,"+
+		" or s3://bucket/prefix")
+	flag.BoolVar(&args.keepMetadata, "keep-metadata", false, "keep EXIF and other metadata of uploaded JPEG and PNG images,"+
+		" which by default is removed as it may include location and camera details")
+	args.maxFileSize = 10 << 20
+	flag.Var(&args.maxFileSize, "max-file", "maximum `size` of a single uploaded file")
+	flag.Var(&args.maxNoteSize, "max-note", "maximum total `size` of files attached to a single note; 0 means no limit")
+	flag.DurationVar(&args.filesGrace, "gc", 0, "remove uploaded files after no note links to them for this `period`;"+
+		" 0 keeps them")
+	flag.StringVar(&args.filesURL, "files-url", "", "serve uploaded files from a separate origin at this base `URL`,"+
+		" e.g. http://files.notes.lan; requests for its host only get files")
+	args.allow = access.DefaultAllow
+	flag.Var(&args.allow, "allow", "comma-separated `list` of CIDR ranges to serve requests from")
+	flag.Var(&args.deny, "deny", "comma-separated `list` of CIDR ranges to refuse requests from,"+
+		" even if they are in the -allow list")
+	flag.Var(&args.proxies, "trusted-proxies", "comma-separated `list` of addresses or CIDR ranges of reverse proxies,"+
+		" whose Forwarded and X-Forwarded-For headers are used to find the client address")
+	flag.BoolVar(&args.passwd, "passwd", false, "read a new login password from stdin, store it in the database and exit;"+
+		" an empty line removes the password")
+	flag.BoolVar(&args.requireLogin, "require-login", false, "require login for requests from loopback and private"+
+		" network addresses too")
+	flag.StringVar(&args.filesAddr, "files-addr", "", "additional `address` to listen for requests for uploaded files"+
+		" only; requires -files-url")
 	flag.Parse()
 	if err := run(ctx, args); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
@@ -52,26 +84,102 @@ func main() {
 type runArgs struct {
 	addr, database string
 	collapsedTags  string
+	trashRetention time.Duration
+	blobs          string
+	maxFileSize    byteSize
+	maxNoteSize    byteSize
+	keepMetadata   bool
+	filesGrace     time.Duration
+	filesURL       string
+	filesAddr      string
+	passwd         bool
+	requireLogin   bool
+	allow          prefixList
+	deny           prefixList
+	proxies        prefixList
 }
 
 func run(ctx context.Context, args runArgs) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	db, err := sql.Open("sqlite", args.database)
+	var filesURL *url.URL
+	if args.filesURL != "" {
+		u, err := url.Parse(args.filesURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("-files-url must be an absolute http or https URL")
+		}
+		filesURL = u
+	} else if args.filesAddr != "" {
+		return errors.New("-files-addr requires -files-url")
+	}
+	// foreign keys are enabled on every connection, as ON DELETE CASCADE
+	// clauses keep note attachments and links consistent; writes wait for
+	// the lock the garbage collection holds while removing blobs
+	db, err := sql.Open("sqlite", args.database+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	if err := initSchema(ctx, db); err != nil {
+	blobs, err := blobstore.Open(ctx, args.blobs, db)
+	if err != nil {
+		return fmt.Errorf("opening blob storage: %w", err)
+	}
+	if err := initSchema(ctx, db, blobs); err != nil {
 		return err
 	}
+	if args.passwd {
+		return setPassword(ctx, db, os.Stdin)
+	}
 	const hdrCC, privateCache = "Cache-Control", "private, max-age=3600"
 	h := newHandler(db)
+	h.blobs = blobs
+	h.maxFileSize, h.maxNoteSize = int64(args.maxFileSize), int64(args.maxNoteSize)
+	h.keepMetadata = args.keepMetadata
 	h.collapsedTags = strings.Split(args.collapsedTags, ",")
+	// resumable uploads are kept next to the database, so that they
+	// survive restarts
+	h.uploadsDir = args.database + "-uploads"
+	if err := os.MkdirAll(h.uploadsDir, 0700); err != nil {
+		return err
+	}
+	go h.dropStaleUploadsLoop(ctx)
+	if err := h.indexLinks(ctx); err != nil {
+		return fmt.Errorf("indexing links: %w", err)
+	}
+	if err := indexFilesText(ctx, db, blobs); err != nil {
+		return fmt.Errorf("indexing text of uploaded files: %w", err)
+	}
+	if h.trashRetention = args.trashRetention; h.trashRetention > 0 {
+		go h.purgeTrashLoop(ctx, h.trashRetention)
+	}
+	if args.filesGrace > 0 {
+		go h.collectFilesLoop(ctx, args.filesGrace)
+	}
+	files := http.Handler(newUploadsHandler(db, blobs))
+	// uploaded files are the only thing served to the separate origin
+	filesMux := http.NewServeMux()
+	filesMux.Handle("/.files/", filesHandler(http.NotFoundHandler(), files))
+	filesMux.Handle("/robots.txt", http.HandlerFunc(noRobots))
+	if filesURL != nil {
+		files = filesRedirect(filesURL)
+	}
 	mux := http.NewServeMux()
 	mux.Handle("/", withHeaders(h, hdrCC, "no-store", "X-Frame-Options", "DENY"))
-	mux.Handle("/.files/", withHeaders(http.FileServer(http.FS(newUploadsFS(db))), hdrCC, privateCache))
+	mux.Handle("/.files/", filesHandler(
+		withHeaders(http.HandlerFunc(h.filesGallery), hdrCC, "no-store", "X-Frame-Options", "DENY"),
+		files))
 	mux.Handle("/.files", http.HandlerFunc(h.uploadFile))
+	mux.Handle("/.uploads", withHeaders(http.HandlerFunc(h.resumableUpload), hdrCC, "no-store"))
+	mux.Handle("/.uploads/", withHeaders(http.HandlerFunc(h.resumableUpload), hdrCC, "no-store"))
+	mux.Handle("/.tags", withHeaders(http.HandlerFunc(h.tagsPage), hdrCC, "no-store", "X-Frame-Options", "DENY"))
+	mux.Handle("/.trash", withHeaders(http.HandlerFunc(h.trashPage), hdrCC, "no-store", "X-Frame-Options", "DENY"))
+	mux.Handle("/.api/", withHeaders(http.HandlerFunc(h.serveAPI), hdrCC, "no-store"))
+	auth := newAuthenticator(db, args.requireLogin)
+	mux.Handle("/.login", withHeaders(http.HandlerFunc(auth.loginPage), hdrCC, "no-store", "X-Frame-Options", "DENY"))
+	mux.Handle("/.login/challenge", withHeaders(http.HandlerFunc(auth.challenge), hdrCC, "no-store"))
+	mux.Handle("/.login/passkey", withHeaders(http.HandlerFunc(auth.passkeyLogin), hdrCC, "no-store"))
+	mux.Handle("/.logout", withHeaders(http.HandlerFunc(auth.logout), hdrCC, "no-store"))
+	mux.Handle("/.passkeys", withHeaders(http.HandlerFunc(auth.passkeysPage), hdrCC, "no-store", "X-Frame-Options", "DENY"))
 	mux.Handle("/robots.txt", http.HandlerFunc(noRobots))
 	mux.Handle("/favicon.ico", withHeaders(http.NotFoundHandler(), hdrCC, privateCache))
 	afs, err := fs.Sub(assetsFS, "assets")
@@ -97,9 +205,32 @@ func run(ctx context.Context, args runArgs) error {
 			http.StripPrefix(prefix, zipserver.Handler(z)),
 			hdrCC, "private, max-age=604800, immutable"))
 	}
+	// uploaded files on the separate origin don't get session cookies, so
+	// they are served without login, relying on their paths being
+	// unguessable
+	policy := &access.Policy{Allow: args.allow, Deny: args.deny, Proxies: args.proxies}
+	handler := auth.require(mux)
+	if filesURL != nil {
+		handler = hostHandler(filesURL.Host, filesMux, handler)
+	}
 	srv := &http.Server{
 		Addr:    args.addr,
-		Handler: nonPublicHandler(httpgzip.New(mux)),
+		Handler: accessHandler(policy, httpgzip.New(handler)),
+	}
+	if args.filesAddr != "" {
+		ln, err := net.Listen("tcp", args.filesAddr)
+		if err != nil {
+			return err
+		}
+		fsrv := &http.Server{Handler: accessHandler(policy, httpgzip.New(filesMux))}
+		go func() { <-ctx.Done(); fsrv.Shutdown(ctx) }()
+		go func() {
+			if err := fsrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Printf("serving files: %v", err)
+				cancel()
+			}
+		}()
+		log.Printf("serving files at http://%s/", ln.Addr())
 	}
 	if strings.HasSuffix(srv.Addr, ":443") {
 		domain, err := knownAcmeDomain(db)
@@ -125,29 +256,89 @@ func run(ctx context.Context, args runArgs) error {
 }
 
 type handler struct {
-	stSearchNotes *sql.Stmt
-	stNotesIndex  *sql.Stmt
-	stEditPage    *sql.Stmt
-	stRenderPage  *sql.Stmt
-	stDeletePage  *sql.Stmt
-	stSavePage    *sql.Stmt
-	stUploadFile  *sql.Stmt
-	collapsedTags []string
+	db              *sql.DB
+	stNotesIndex    *sql.Stmt
+	stEditPage      *sql.Stmt
+	stRenderPage    *sql.Stmt
+	stDeletePage    *sql.Stmt
+	stSavePage      *sql.Stmt
+	stUploadFile    *sql.Stmt
+	stAttachFile    *sql.Stmt
+	stNoteFilesSize *sql.Stmt
+	stListFiles     *sql.Stmt
+	stGetNote       *sql.Stmt
+	stPageExists    *sql.Stmt
+	stNotesPage     *sql.Stmt
+	stTags          *sql.Stmt
+	stBacklinks     *sql.Stmt
+	stClearLinks    *sql.Stmt
+	stAddLink       *sql.Stmt
+	stRedirect      *sql.Stmt
+	stDropRedirect  *sql.Stmt
+	stHistory       *sql.Stmt
+	stVersion       *sql.Stmt
+	blobs           blobstore.Store
+	collapsedTags   []string
+	// upload size limits, zero maxNoteSize means no limit
+	maxFileSize, maxNoteSize int64
+	// whether to keep EXIF and other metadata of uploaded images
+	keepMetadata bool
+	// how long deleted notes are kept in the trash, zero means forever
+	trashRetention time.Duration
+	// directory keeping files of resumable uploads in progress
+	uploadsDir string
 }
 
 func newHandler(db *sql.DB) *handler {
 	return &handler{
-		stSearchNotes: mustPrepare(db, `SELECT Title, Path, Tags, snippet(notes_fts, 2, '<ftsMark>', '</ftsMark>', '...', 20)
-			FROM notes_fts WHERE notes_fts MATCH ? ORDER BY rank;`),
+		db:           db,
 		stNotesIndex: mustPrepare(db, `SELECT Title, Path, Mtime, Tags FROM notes ORDER BY Mtime DESC`),
 		stEditPage:   mustPrepare(db, `SELECT Text FROM notes WHERE Path=@path`),
 		stRenderPage: mustPrepare(db, `SELECT Title, Text, Mtime, Tags FROM notes WHERE Path=@path`),
 		stDeletePage: mustPrepare(db, `DELETE FROM notes WHERE Path=@path`),
-		stSavePage: mustPrepare(db, `INSERT INTO notes(Path,Title,Text,Tags)
-			VALUES(@path,@title,@text,@tags)
+		stSavePage: mustPrepare(db, `INSERT INTO notes(Path,Title,Text,Tags,Meta,Ctime)
+			VALUES(@path,@title,@text,@tags,@meta,coalesce(@ctime,strftime('%s','now')))
 			ON CONFLICT(Path) DO UPDATE
-			SET Title=excluded.Title, Text=excluded.Text, Mtime=excluded.Mtime, Tags=excluded.Tags`),
-		stUploadFile: mustPrepare(db, `INSERT OR IGNORE INTO files(Path,Bytes,NotePath) VALUES(@path,@bytes,@notepath)`),
+			SET Title=excluded.Title, Text=excluded.Text, Mtime=excluded.Mtime, Tags=excluded.Tags,
+			Meta=excluded.Meta, Ctime=coalesce(@ctime,Ctime)`),
+		stUploadFile: mustPrepare(db, `INSERT OR IGNORE INTO files(Path,Hash,Size,Original,SourceHash,Type,Name,Width,Height)
+			VALUES(@path,@hash,@size,@original,@sourcehash,@type,@name,@width,@height)`),
+		stAttachFile: mustPrepare(db, `INSERT OR IGNORE INTO note_files(NotePath,Path) VALUES(@notepath,@path)`),
+		stNoteFilesSize: mustPrepare(db, `SELECT coalesce(sum(files.Size),0) FROM files JOIN note_files USING(Path)
+			WHERE note_files.NotePath=@notepath AND files.Path<>@path`),
+		stListFiles: mustPrepare(db, `SELECT files.Path, files.Size, coalesce(note_files.Ctime, files.Ctime),
+			(SELECT t.Path FROM files t WHERE t.Original=files.Path ORDER BY t.Size LIMIT 1),
+			(SELECT json_group_array(json_array(notes.Path, notes.Title)) FROM note_files n
+				JOIN notes ON notes.Path=n.NotePath WHERE n.Path=files.Path),
+			coalesce(files.Type,''), coalesce(files.Name,''), coalesce(files.Width,0), coalesce(files.Height,0)
+			FROM files LEFT JOIN note_files ON note_files.Path=files.Path AND note_files.NotePath=@notepath
+			WHERE (@notepath='' OR note_files.NotePath IS NOT NULL) AND files.Original IS NULL
+			ORDER BY 3 DESC, files.Path`),
+		stGetNote: mustPrepare(db, `SELECT Title, Text, Ctime, Mtime, Tags, Meta FROM notes WHERE Path=@path`),
+		stPageExists: mustPrepare(db, `SELECT EXISTS(SELECT 1 FROM notes WHERE Path=@path)
+			OR EXISTS(SELECT 1 FROM redirects JOIN notes ON notes.Path=redirects.Target WHERE redirects.Path=@path)
+			OR EXISTS(SELECT 1 FROM notes, json_each(notes.Meta, '$.aliases') WHERE json_each.value=@path)`),
+		stNotesPage: mustPrepare(db, `SELECT Path, Title, Ctime, Mtime, Tags, Meta FROM notes
+			ORDER BY Mtime DESC, Path LIMIT @limit OFFSET @offset`),
+		stTags: mustPrepare(db, `SELECT json_each.value, count(*), max(notes.Mtime)
+			FROM notes, json_each(notes.Tags) GROUP BY json_each.value ORDER BY json_each.value`),
+		stBacklinks: mustPrepare(db, `SELECT notes.Path, notes.Title, links.Snippet
+			FROM links JOIN notes ON notes.Path=links.Source
+			WHERE (links.Target=@path OR links.Target IN (SELECT Path FROM redirects WHERE Target=@path)
+			OR links.Target IN (SELECT value FROM json_each((SELECT Meta FROM notes WHERE Path=@path), '$.aliases')))
+			AND notes.Path<>@path
+			GROUP BY notes.Path ORDER BY notes.Title`),
+		stClearLinks: mustPrepare(db, `DELETE FROM links WHERE Source=@source`),
+		stAddLink:    mustPrepare(db, `INSERT OR IGNORE INTO links(Source,Target,Snippet) VALUES(@source,@target,@snippet)`),
+		// redirects to deleted notes are skipped, and work again once the
+		// note is restored from the trash
+		stRedirect: mustPrepare(db, `SELECT redirects.Target FROM redirects
+			JOIN notes ON notes.Path=redirects.Target WHERE redirects.Path=@path
+			UNION ALL SELECT notes.Path FROM notes, json_each(notes.Meta, '$.aliases') WHERE json_each.value=@path
+			LIMIT 1`),
+		stDropRedirect: mustPrepare(db, `DELETE FROM redirects WHERE Path=@path`),
+		stHistory:      mustPrepare(db, `SELECT ID, Title, Mtime FROM notes_history WHERE Path=@path ORDER BY Mtime DESC, ID DESC`),
+		stVersion:      mustPrepare(db, `SELECT Title, Text, Mtime FROM notes_history WHERE Path=@path AND ID=@id`),
 	}
 }
 
@@ -176,10 +367,34 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.editPage(w, r)
 		return
 	}
+	if r.Method == http.MethodGet && r.URL.Query().Has("history") {
+		h.pageHistory(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Has("move") {
+		h.movePage(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Has("diff") {
+		h.diffPage(w, r)
+		return
+	}
+	if r.URL.Query().Has("files") {
+		if r.Method == http.MethodPost {
+			h.filesAction(w, r)
+		} else {
+			h.noteFiles(w, r)
+		}
+		return
+	}
 	if r.Method == http.MethodPost {
 		h.savePage(w, r)
 		return
 	}
+	if r.Method == http.MethodGet && wantsMarkdown(r) {
+		h.rawPage(w, r)
+		return
+	}
 	if r.Method == http.MethodGet {
 		h.renderPage(w, r)
 		return
@@ -188,21 +403,22 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (h *handler) renderIndex(w http.ResponseWriter, r *http.Request) {
 	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
-		entries, err := searchNotes(r.Context(), h.stSearchNotes, q)
+		advanced := r.URL.Query().Get("advanced") != ""
+		res, err := searchNotes(r.Context(), h.db, q, advanced)
+		var errText string
 		if err != nil && err != sql.ErrNoRows {
-			var se *sqlite.Error
-			if errors.As(err, &se) && se.Code() == 1 {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			if !isSyntaxError(err) {
+				log.Printf("search for %q: %v", q, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 				return
 			}
-			log.Printf("search for %q: %v", q, err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
+			errText = err.Error()
 		}
 		searchResultsTemplate.Execute(w, struct {
-			Term    string
-			Results []indexEntry
-		}{Term: q, Results: entries})
+			Term, Error string
+			Advanced    bool
+			searchResult
+		}{Term: q, Error: errText, Advanced: advanced, searchResult: res})
 		return
 	}
 	entries, err := notesIndex(r.Context(), h.stNotesIndex, h.collapsedTags)
@@ -214,33 +430,6 @@ func (h *handler) renderIndex(w http.ResponseWriter, r *http.Request) {
 	indexTemplate.Execute(w, entries)
 }
 
-func searchNotes(ctx context.Context, stmt *sql.Stmt, term string) ([]indexEntry, error) {
-	if term == "" {
-		return nil, errors.New("empty search term")
-	}
-	rows, err := stmt.QueryContext(ctx, term)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var out []indexEntry
-	var tagsJson []byte
-	for rows.Next() {
-		var ent indexEntry
-		var snippet string
-		tagsJson = tagsJson[:0]
-		if err := rows.Scan(&ent.Title, &ent.Path, &tagsJson, &snippet); err != nil {
-			return nil, err
-		}
-		if len(tagsJson) != 0 {
-			_ = json.Unmarshal(tagsJson, &ent.Tags)
-		}
-		ent.Snippet = template.HTML(htmlEscaper.Replace(snippet))
-		out = append(out, ent)
-	}
-	return out, rows.Err()
-}
-
 func notesIndex(ctx context.Context, stmt *sql.Stmt, collapsedTags []string) ([]indexEntry, error) {
 	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
@@ -291,6 +480,32 @@ rowsLoop:
 	return out, nil
 }
 
+// tagInfo describes a single tag used across notes
+type tagInfo struct {
+	Tag   string
+	Count int       // number of notes with this tag
+	Mtime time.Time // time of the most recent update of a note with this tag
+}
+
+func allTags(ctx context.Context, stmt *sql.Stmt) ([]tagInfo, error) {
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []tagInfo
+	for rows.Next() {
+		var ti tagInfo
+		var mtime int64
+		if err := rows.Scan(&ti.Tag, &ti.Count, &mtime); err != nil {
+			return nil, err
+		}
+		ti.Mtime = time.Unix(mtime, 0).UTC()
+		out = append(out, ti)
+	}
+	return out, rows.Err()
+}
+
 type indexEntry struct {
 	Title, Path string
 	Snippet     template.HTML
@@ -305,9 +520,12 @@ func (h *handler) editPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid path", http.StatusBadRequest)
 		return
 	}
-	var text string
+	var text, version string
 	switch err := h.stEditPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&text); err {
-	case nil, sql.ErrNoRows:
+	case nil:
+		version = textVersion(text)
+		w.Header().Set("ETag", strconv.Quote(version))
+	case sql.ErrNoRows:
 	default:
 		log.Printf("edit %q: %v", r.URL, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -316,11 +534,12 @@ func (h *handler) editPage(w http.ResponseWriter, r *http.Request) {
 	if text == "" {
 		text = "# Page title\n\nPut your text here, save with Cmd-s.\n"
 	}
+	data := struct{ Text, Version string }{Text: text, Version: version}
 	if r.URL.RawQuery == "edit=basic" {
-		editPageTemplate.Execute(w, struct{ Text string }{Text: text})
+		editPageTemplate.Execute(w, data)
 		return
 	}
-	richEditPageTemplate.Execute(w, struct{ Text string }{Text: text})
+	richEditPageTemplate.Execute(w, data)
 }
 
 func (h *handler) renderPage(w http.ResponseWriter, r *http.Request) {
@@ -335,7 +554,16 @@ func (h *handler) renderPage(w http.ResponseWriter, r *http.Request) {
 	switch err := h.stRenderPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&title, &text, &mtime, &tagsJson); err {
 	case nil:
 	case sql.ErrNoRows:
-		pageNotFound(w, r)
+		var target string
+		switch err := h.stRedirect.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&target); err {
+		case nil:
+			http.Redirect(w, r, (&url.URL{Path: "/" + target}).String(), http.StatusMovedPermanently)
+		case sql.ErrNoRows:
+			pageNotFound(w, r)
+		default:
+			log.Printf("redirect %q: %v", r.URL, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
 		return
 	default:
 		log.Printf("get %q: %v", r.URL, err)
@@ -349,7 +577,7 @@ func (h *handler) renderPage(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	buf := new(bytes.Buffer)
-	bodyBytes := []byte(text)
+	_, bodyBytes := markdown.FrontMatter([]byte(text))
 	doc := markdown.Markdown.Parser().Parse(gtext.NewReader(bodyBytes))
 	headers, err := markdown.AssignHeaderIDs(bodyBytes, doc)
 	if err != nil {
@@ -357,6 +585,11 @@ func (h *handler) renderPage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	if err := markdown.ResolveWikiLinks(doc, pageLookup{ctx: r.Context(), stmt: h.stPageExists}); err != nil {
+		log.Printf("resolving wiki links %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	if err := markdown.Markdown.Renderer().Render(buf, bodyBytes, doc); err != nil {
 		log.Printf("render %q: %v", r.URL, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -365,22 +598,66 @@ func (h *handler) renderPage(w http.ResponseWriter, r *http.Request) {
 	if len(headers) < 2 || !markdown.WordCountAtLeast(bodyBytes, 300) {
 		headers = nil
 	}
+	backlinks, err := noteBacklinks(r.Context(), h.stBacklinks, p)
+	if err != nil {
+		log.Printf("backlinks %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Last-Modified", time.Unix(mtime, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", strconv.Quote(textVersion(text)))
 	pageTemplate.Execute(w, struct {
-		TOC     []markdown.HeadingInfo
-		Title   string
-		Text    template.HTML
-		HasCode bool
-		Tags    []string
+		TOC       []markdown.HeadingInfo
+		Title     string
+		Text      template.HTML
+		HasCode   bool
+		Tags      []string
+		Backlinks []backlink
 	}{
-		TOC:     headers,
-		Title:   title,
-		Text:    template.HTML(buf.String()),
-		HasCode: bytes.Contains(buf.Bytes(), []byte("<pre><code")),
-		Tags:    tags,
+		TOC:       headers,
+		Title:     title,
+		Text:      template.HTML(buf.String()),
+		HasCode:   bytes.Contains(buf.Bytes(), []byte("<pre><code")),
+		Tags:      tags,
+		Backlinks: backlinks,
 	})
 }
 
+// backlink describes a note linking to another one
+type backlink struct {
+	Path, Title string
+	Snippet     string
+}
+
+func noteBacklinks(ctx context.Context, stmt *sql.Stmt, p string) ([]backlink, error) {
+	rows, err := stmt.QueryContext(ctx, sql.Named("path", p))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []backlink
+	for rows.Next() {
+		var bl backlink
+		if err := rows.Scan(&bl.Path, &bl.Title, &bl.Snippet); err != nil {
+			return nil, err
+		}
+		out = append(out, bl)
+	}
+	return out, rows.Err()
+}
+
+// pageLookup implements markdown.PageLookup over the notes table
+type pageLookup struct {
+	ctx  context.Context
+	stmt *sql.Stmt
+}
+
+func (l pageLookup) PageExists(p string) (bool, error) {
+	var ok bool
+	err := l.stmt.QueryRowContext(l.ctx, sql.Named("path", p)).Scan(&ok)
+	return ok, err
+}
+
 func (h *handler) savePage(w http.ResponseWriter, r *http.Request) {
 	p := strings.TrimLeft(r.URL.Path, "/")
 	if p == "." || !fs.ValidPath(p) {
@@ -391,9 +668,12 @@ func (h *handler) savePage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if to := r.PostForm.Get("move"); to != "" {
+		h.moveFromForm(w, r, p, to)
+		return
+	}
 	if r.PostForm.Get("delete") == "true" {
-		_, err := h.stDeletePage.ExecContext(r.Context(), sql.Named("path", p))
-		switch err {
+		switch err := h.deleteNote(r.Context(), p); err {
 		case nil, sql.ErrNoRows:
 			http.Redirect(w, r, "/", http.StatusSeeOther)
 		default:
@@ -402,83 +682,514 @@ func (h *handler) savePage(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	text := strings.TrimSpace(r.PostForm.Get("text"))
-	if text == "" {
-		http.Error(w, "Empty text", http.StatusBadRequest)
+	text := r.PostForm.Get("text")
+	if id := r.PostForm.Get("restore"); id != "" {
+		var title string
+		var mtime int64
+		switch err := h.stVersion.QueryRowContext(r.Context(), sql.Named("path", p), sql.Named("id", id)).Scan(&title, &text, &mtime); err {
+		case nil:
+		case sql.ErrNoRows:
+			http.Error(w, "No such version", http.StatusNotFound)
+			return
+		default:
+			log.Printf("restoring %q version %q: %v", p, id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	text, err := cleanText(text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !utf8.ValidString(text) {
-		http.Error(w, "Text is not a valid utf8", http.StatusBadRequest)
+	// edit forms carry the version of the note they were opened with, other
+	// clients may use conditional request headers
+	var expect *string
+	if r.PostForm.Has("version") {
+		v := r.PostForm.Get("version")
+		expect = &v
+	} else if v, ok := requestPrecondition(r); ok {
+		expect = &v
+	}
+	_, err = h.saveNote(r.Context(), p, text, expect)
+	var ce *conflictError
+	switch {
+	case err == nil:
+	case errors.As(err, &ce) && r.PostForm.Has("version"):
+		w.WriteHeader(http.StatusConflict)
+		conflictTemplate.Execute(w, struct {
+			Path, Text, Version string
+			Lines               []diffLine
+		}{
+			Path:    p,
+			Text:    text,
+			Version: ce.version(),
+			Lines:   diffLines(ce.Text, text),
+		})
+		return
+	case errors.As(err, &ce):
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	default:
+		log.Printf("updating %q: %v", p, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	text = crlf.Replace(text)
-	tags := noteTags(text)
-	var tagsJson []byte
-	if len(tags) != 0 {
-		var err error
-		if tagsJson, err = json.Marshal(tags); err != nil {
-			panic(err)
+	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+}
+
+// cleanText validates and normalizes note text before it is saved
+func cleanText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("empty text")
+	}
+	if !utf8.ValidString(text) {
+		return "", errors.New("text is not a valid utf8")
+	}
+	return crlf.Replace(text), nil
+}
+
+// saveNote creates or updates note at path p and reports whether a new note
+// was created. If expect is not nil, the note is only saved if its current
+// state matches it: an empty value expects the note not to exist, "*" matches
+// any existing note, anything else must match the note's current version as
+// reported by textVersion. If the note does not match, saveNote returns
+// *conflictError.
+func (h *handler) saveNote(ctx context.Context, p, text string, expect *string) (created bool, err error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var current string
+	var exists bool
+	switch err := tx.StmtContext(ctx, h.stEditPage).QueryRowContext(ctx, sql.Named("path", p)).Scan(&current); err {
+	case nil:
+		exists = true
+	case sql.ErrNoRows:
+	default:
+		return false, err
+	}
+	if expect != nil {
+		var ok bool
+		switch *expect {
+		case "":
+			ok = !exists
+		case "*":
+			ok = exists
+		default:
+			ok = exists && textVersion(current) == *expect
+		}
+		if !ok {
+			return false, &conflictError{Text: current, Exists: exists}
 		}
 	}
-	_, err := h.stSavePage.ExecContext(r.Context(),
+	if err := h.storeNote(ctx, tx, p, text); err != nil {
+		return false, err
+	}
+	return !exists, tx.Commit()
+}
+
+// storeNote creates or updates note at path p within a transaction, keeping
+// data derived from its text up to date
+func (h *handler) storeNote(ctx context.Context, tx *sql.Tx, p, text string) error {
+	note := parseNote(text)
+	tags, meta, ctime := note.columns()
+	_, err := tx.StmtContext(ctx, h.stSavePage).ExecContext(ctx,
 		sql.Named("path", p),
-		sql.Named("title", textTitle(text)),
+		sql.Named("title", note.Title),
 		sql.Named("text", text),
-		sql.Named("tags", tagsJson),
+		sql.Named("tags", tags),
+		sql.Named("meta", meta),
+		sql.Named("ctime", ctime),
 	)
 	if err != nil {
-		log.Printf("updating %q: %v", p, err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return err
 	}
-	http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	if _, err := tx.StmtContext(ctx, h.stDropRedirect).ExecContext(ctx, sql.Named("path", p)); err != nil {
+		return err
+	}
+	return h.updateLinks(ctx, tx, p, text)
+}
+
+// updateLinks replaces links going out of note at path p with the ones found in
+// its text
+func (h *handler) updateLinks(ctx context.Context, tx *sql.Tx, p, text string) error {
+	if _, err := tx.StmtContext(ctx, h.stClearLinks).ExecContext(ctx, sql.Named("source", p)); err != nil {
+		return err
+	}
+	_, body := markdown.FrontMatter([]byte(text))
+	doc := markdown.Markdown.Parser().Parse(gtext.NewReader(body))
+	st := tx.StmtContext(ctx, h.stAddLink)
+	for _, l := range markdown.LocalLinks(body, doc, p) {
+		if _, err := st.ExecContext(ctx,
+			sql.Named("source", p),
+			sql.Named("target", l.Path),
+			sql.Named("snippet", l.Context),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linksIndexedVersion is the database user_version set once the links table
+// is filled from the notes saved before it was created
+const linksIndexedVersion = 1
+
+// indexLinks fills the links table from the existing notes once, recording
+// that in the database user_version, so that databases without any links are
+// not indexed again on every start
+func (h *handler) indexLinks(ctx context.Context) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil || version >= linksIndexedVersion {
+		return err
+	}
+	type note struct{ path, text string }
+	var notes []note
+	rows, err := tx.QueryContext(ctx, `SELECT Path, Text FROM notes`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n note
+		if err := rows.Scan(&n.path, &n.text); err != nil {
+			return err
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if err := h.updateLinks(ctx, tx, n.path, n.text); err != nil {
+			return fmt.Errorf("indexing links of %q: %w", n.path, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version=%d`, linksIndexedVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func initSchema(ctx context.Context, db *sql.DB) error {
+// conflictError is returned by saveNote when note does not match the expected
+// version
+type conflictError struct {
+	Text   string // current text of the note
+	Exists bool   // whether the note currently exists
+}
+
+func (e *conflictError) Error() string { return "note was changed concurrently" }
+
+// version returns a value that can be used as a saveNote expectation matching
+// the note state reported by this error
+func (e *conflictError) version() string {
+	if !e.Exists {
+		return ""
+	}
+	return textVersion(e.Text)
+}
+
+// textVersion returns a value identifying note text, suitable for use as an
+// entity tag
+func textVersion(text string) string {
+	sum := sha1.Sum([]byte(text))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// requestPrecondition translates If-Match and If-None-Match request headers
+// into an expectation for saveNote
+func requestPrecondition(r *http.Request) (string, bool) {
+	if v := strings.TrimSpace(r.Header.Get("If-Match")); v != "" {
+		if v == "*" {
+			return v, true
+		}
+		v, _, _ = strings.Cut(v, ",")
+		return strings.Trim(strings.TrimPrefix(strings.TrimSpace(v), "W/"), `"`), true
+	}
+	if strings.TrimSpace(r.Header.Get("If-None-Match")) == "*" {
+		return "", true
+	}
+	return "", false
+}
+
+func initSchema(ctx context.Context, db *sql.DB, blobs blobstore.Store) error {
+	var hasTrigram bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE name='notes_trigram')`).
+		Scan(&hasTrigram); err != nil {
+		return err
+	}
 	for _, s := range [...]string{
 		`PRAGMA journal_mode=WAL`,
 		`PRAGMA synchronous=normal`,
-		`PRAGMA foreign_keys=ON`,
 		`CREATE TABLE IF NOT EXISTS notes(
 			Path TEXT PRIMARY KEY NOT NULL,
 			Title TEXT NOT NULL,
 			Text TEXT NOT NULL,
 			Ctime INT NOT NULL DEFAULT (strftime('%s','now')), -- unix timestamp of time created
 			Mtime INT NOT NULL DEFAULT (strftime('%s','now')), -- unix timestamp of time updated
-			Tags TEXT check(Tags is NULL OR(json_valid(Tags) AND json_type(Tags)='array'))
+			Tags TEXT check(Tags is NULL OR(json_valid(Tags) AND json_type(Tags)='array')),
+			Meta TEXT check(Meta is NULL OR(json_valid(Meta) AND json_type(Meta)='object')) -- YAML front matter
 		)`,
 		`CREATE INDEX IF NOT EXISTS notesMtime ON notes(Mtime DESC)`,
 		// full text search-related
 		`CREATE VIRTUAL TABLE IF NOT EXISTS notes_fts USING fts5(Path, Title, 'Text', Tags, content=notes)`,
-		`CREATE TRIGGER IF NOT EXISTS notes_ai AFTER INSERT ON notes BEGIN
+		// substring search
+		`CREATE VIRTUAL TABLE IF NOT EXISTS notes_trigram USING fts5(Path, Title, 'Text', Tags, content=notes, tokenize='trigram')`,
+		// text of uploaded files, by content hash
+		`CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5(Hash UNINDEXED, 'Text')`,
+		// triggers are recreated so that databases created before the
+		// trigram index was added get them updated
+		`DROP TRIGGER IF EXISTS notes_ai`,
+		`DROP TRIGGER IF EXISTS notes_ad`,
+		`DROP TRIGGER IF EXISTS notes_au`,
+		`CREATE TRIGGER notes_ai AFTER INSERT ON notes BEGIN
 			INSERT INTO notes_fts(rowid, Path, Title, "Text", Tags)
 				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
+			INSERT INTO notes_trigram(rowid, Path, Title, "Text", Tags)
+				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
 		END`,
-		`CREATE TRIGGER IF NOT EXISTS notes_ad AFTER DELETE ON notes BEGIN
+		`CREATE TRIGGER notes_ad AFTER DELETE ON notes BEGIN
 			INSERT INTO notes_fts(notes_fts, rowid, Path, Title, "Text", Tags)
 				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
+			INSERT INTO notes_trigram(notes_trigram, rowid, Path, Title, "Text", Tags)
+				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
 		END`,
-		`CREATE TRIGGER IF NOT EXISTS notes_au AFTER UPDATE ON notes BEGIN
+		`CREATE TRIGGER notes_au AFTER UPDATE ON notes BEGIN
 			INSERT INTO notes_fts(notes_fts, rowid, Path, Title, "Text", Tags)
 				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
 			INSERT INTO notes_fts(rowid, Path, Title, "Text", Tags)
 				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
+			INSERT INTO notes_trigram(notes_trigram, rowid, Path, Title, "Text", Tags)
+				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
+			INSERT INTO notes_trigram(rowid, Path, Title, "Text", Tags)
+				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
+		END`,
+		// previous versions of notes, kept by path, so that they outlive the
+		// note itself
+		`CREATE TABLE IF NOT EXISTS notes_history(
+			ID INTEGER PRIMARY KEY,
+			Path TEXT NOT NULL,
+			Title TEXT NOT NULL,
+			Text TEXT NOT NULL,
+			Mtime INT NOT NULL, -- unix timestamp of time this version was saved
+			Tags TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS notesHistoryPath ON notes_history(Path, Mtime DESC)`,
+		`CREATE TRIGGER IF NOT EXISTS notes_history_au AFTER UPDATE ON notes WHEN old.Text IS NOT new.Text BEGIN
+			INSERT INTO notes_history(Path, Title, Text, Mtime, Tags)
+				VALUES (old.Path, old.Title, old.Text, old.Mtime, old.Tags);
 		END`,
-		// file uploads (temporary, to be later offloaded to S3)
+		// links between notes, Target may point to a non-existent note
+		`CREATE TABLE IF NOT EXISTS links(
+			Source TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE,
+			Target TEXT NOT NULL,
+			Snippet TEXT NOT NULL, -- text around the link in the source note
+			PRIMARY KEY(Source, Target)
+		)`,
+		`CREATE INDEX IF NOT EXISTS linksTarget ON links(Target)`,
+		// old paths of moved notes
+		`CREATE TABLE IF NOT EXISTS redirects(
+			Path TEXT PRIMARY KEY NOT NULL,
+			Target TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS redirectsTarget ON redirects(Target)`,
+		// deleted notes and their attachments
+		`CREATE TABLE IF NOT EXISTS trash(
+			ID INTEGER PRIMARY KEY,
+			Path TEXT NOT NULL,
+			Title TEXT NOT NULL,
+			Text TEXT NOT NULL,
+			Ctime INT NOT NULL,
+			Mtime INT NOT NULL,
+			Tags TEXT,
+			Meta TEXT,
+			Dtime INT NOT NULL DEFAULT (strftime('%s','now')) -- unix timestamp of time deleted
+		)`,
+		`CREATE INDEX IF NOT EXISTS trashDtime ON trash(Dtime)`,
+		`CREATE TABLE IF NOT EXISTS trash_files(
+			Path TEXT NOT NULL,
+			Hash TEXT NOT NULL,
+			Size INT NOT NULL,
+			Ctime INT NOT NULL,
+			Original TEXT,
+			SourceHash TEXT,
+			TrashID INT NOT NULL REFERENCES trash(ID) ON DELETE CASCADE,
+			Type TEXT,
+			Name TEXT,
+			Width INT,
+			Height INT,
+			PRIMARY KEY(TrashID, Path)
+		)`,
+		// file uploads, their content is kept in the blob storage
 		`CREATE TABLE IF NOT EXISTS files(
 			Path TEXT PRIMARY KEY NOT NULL,
-			Bytes BLOB NOT NULL,
+			Hash TEXT NOT NULL, -- blob storage key, also the second element of Path
+			Size INT NOT NULL,
 			Ctime INT NOT NULL DEFAULT (strftime('%s','now')), -- unix timestamp of time created
-			NotePath TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE
+			Original TEXT, -- for thumbnails, path of the uploaded image
+			SourceHash TEXT, -- hash of the file as uploaded, if its metadata was removed
+			Orphaned INT, -- unix timestamp of time no note was found linking to the file
+			Type TEXT, -- media type
+			Name TEXT, -- file name as uploaded
+			Width INT, -- image dimensions
+			Height INT
+		)`,
+		// notes the files were uploaded to, thumbnails are not listed here,
+		// they go along with their original
+		`CREATE TABLE IF NOT EXISTS note_files(
+			NotePath TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE,
+			Path TEXT NOT NULL REFERENCES files(Path) ON DELETE CASCADE,
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')), -- unix timestamp of time uploaded to the note
+			PRIMARY KEY(NotePath, Path)
+		)`,
+		`CREATE INDEX IF NOT EXISTS noteFilesPath ON note_files(Path)`,
+		// resumable uploads in progress, see resumable.go
+		`CREATE TABLE IF NOT EXISTS uploads(
+			ID TEXT PRIMARY KEY NOT NULL,
+			NotePath TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE,
+			Name TEXT NOT NULL,
+			Size INT NOT NULL,
+			Received INT NOT NULL DEFAULT 0, -- number of bytes received so far
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+			Type TEXT -- media type declared by the client
+		)`,
+		// login password hash and the key signing session cookies
+		`CREATE TABLE IF NOT EXISTS auth(
+			Key TEXT PRIMARY KEY NOT NULL,
+			Value BLOB NOT NULL
+		)`,
+		`INSERT OR IGNORE INTO auth(Key,Value) VALUES('session',randomblob(32))`,
+		`CREATE TABLE IF NOT EXISTS passkeys(
+			ID BLOB PRIMARY KEY NOT NULL, -- credential ID
+			PublicKey BLOB NOT NULL, -- DER-encoded SubjectPublicKeyInfo
+			Name TEXT NOT NULL,
+			SignCount INT NOT NULL DEFAULT 0,
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+			Atime INT -- unix timestamp of the last login
 		)`,
 	} {
 		if _, err := db.ExecContext(ctx, s); err != nil {
 			return fmt.Errorf("SQL statement %q: %w", s, err)
 		}
 	}
+	if !hasTrigram {
+		if _, err := db.ExecContext(ctx, `INSERT INTO notes_trigram(notes_trigram) VALUES('rebuild')`); err != nil {
+			return fmt.Errorf("building trigram index: %w", err)
+		}
+	}
+	// columns added to already existing tables
+	added, err := addColumn(ctx, db, "notes", "Meta",
+		`TEXT check(Meta is NULL OR(json_valid(Meta) AND json_type(Meta)='object'))`)
+	if err != nil {
+		return err
+	}
+	if added {
+		if err := indexFrontMatter(ctx, db); err != nil {
+			return fmt.Errorf("indexing front matter: %w", err)
+		}
+	}
+	if _, err := addColumn(ctx, db, "trash", "Meta", `TEXT`); err != nil {
+		return err
+	}
+	if err := moveLegacyBlobs(ctx, db, blobs); err != nil {
+		return fmt.Errorf("moving uploaded files to the blob storage: %w", err)
+	}
+	if _, err := addColumn(ctx, db, "files", "Original", `TEXT`); err != nil {
+		return err
+	}
+	if _, err := addColumn(ctx, db, "trash_files", "Original", `TEXT`); err != nil {
+		return err
+	}
+	if _, err := addColumn(ctx, db, "files", "SourceHash", `TEXT`); err != nil {
+		return err
+	}
+	if _, err := addColumn(ctx, db, "trash_files", "SourceHash", `TEXT`); err != nil {
+		return err
+	}
+	if _, err := addColumn(ctx, db, "files", "Orphaned", `INT`); err != nil {
+		return err
+	}
+	if err := splitNoteFiles(ctx, db); err != nil {
+		return fmt.Errorf("moving file owners to the note_files table: %w", err)
+	}
+	for _, table := range [...]string{"files", "trash_files"} {
+		for _, c := range [...]struct{ name, decl string }{
+			{"Type", `TEXT`}, {"Name", `TEXT`}, {"Width", `INT`}, {"Height", `INT`},
+		} {
+			if _, err := addColumn(ctx, db, table, c.name, c.decl); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := addColumn(ctx, db, "uploads", "Type", `TEXT`); err != nil {
+		return err
+	}
+	if err := fillFileTypes(ctx, db); err != nil {
+		return fmt.Errorf("setting types of uploaded files: %w", err)
+	}
+	// created after moveLegacyBlobs and splitNoteFiles, which recreate the
+	// files and trash_files tables
+	for _, s := range [...]string{
+		`CREATE INDEX IF NOT EXISTS filesOriginal ON files(Original)`,
+		// files are removed once the last note they were uploaded to is
+		// gone, and thumbnails go along with their original
+		`CREATE TRIGGER IF NOT EXISTS note_files_ad AFTER DELETE ON note_files BEGIN
+			DELETE FROM files WHERE Path=old.Path AND NOT EXISTS(SELECT 1 FROM note_files WHERE Path=old.Path);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS files_thumbnails_ad AFTER DELETE ON files BEGIN
+			DELETE FROM files WHERE Original=old.Path;
+		END`,
+		// hashes of deleted files, their blobs are removed once no files use
+		// them, see internal/filegc
+		`CREATE TABLE IF NOT EXISTS orphan_blobs(Hash TEXT PRIMARY KEY NOT NULL)`,
+		`CREATE TRIGGER IF NOT EXISTS files_ad AFTER DELETE ON files BEGIN
+			INSERT OR IGNORE INTO orphan_blobs(Hash) VALUES (old.Hash);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS trash_files_ad AFTER DELETE ON trash_files BEGIN
+			INSERT OR IGNORE INTO orphan_blobs(Hash) VALUES (old.Hash);
+		END`,
+		// text of a file is kept while any file or file in the trash has the
+		// same content
+		`CREATE INDEX IF NOT EXISTS filesHash ON files(Hash)`,
+		`CREATE TRIGGER IF NOT EXISTS files_fts_ad AFTER DELETE ON files WHEN old.Original IS NULL BEGIN
+			DELETE FROM files_fts WHERE Hash=old.Hash AND NOT EXISTS(SELECT 1 FROM files WHERE Hash=old.Hash)
+				AND NOT EXISTS(SELECT 1 FROM trash_files WHERE Hash=old.Hash);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS trash_files_fts_ad AFTER DELETE ON trash_files WHEN old.Original IS NULL BEGIN
+			DELETE FROM files_fts WHERE Hash=old.Hash AND NOT EXISTS(SELECT 1 FROM files WHERE Hash=old.Hash)
+				AND NOT EXISTS(SELECT 1 FROM trash_files WHERE Hash=old.Hash);
+		END`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			return fmt.Errorf("SQL statement %q: %w", s, err)
+		}
+	}
 	return nil
 }
 
+// addColumn adds a column to the table unless it already has it, and reports
+// whether the column was added
+func addColumn(ctx context.Context, db *sql.DB, table, column, decl string) (bool, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name=?)`,
+		table, column).Scan(&exists); err != nil || exists {
+		return false, err
+	}
+	s := fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl)
+	if _, err := db.ExecContext(ctx, s); err != nil {
+		return false, fmt.Errorf("SQL statement %q: %w", s, err)
+	}
+	return true, nil
+}
+
 func textTitle(text string) string {
 	const cutset = "#\t\r\n "
 	var out string
@@ -498,6 +1209,11 @@ func noRobots(w http.ResponseWriter, _ *http.Request) {
 	io.WriteString(w, "User-agent: *\nDisallow: /\n")
 }
 
+// reservedPath reports whether the first element of the note path p starts
+// with a dot: such paths are taken by the server pages, like /.files/ or
+// /.trash, so notes there could not be opened
+func reservedPath(p string) bool { return strings.HasPrefix(p, ".") }
+
 func pageNotFound(w http.ResponseWriter, r *http.Request) {
 	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
 		http.NotFound(w, r)
@@ -567,11 +1283,24 @@ var (
 	pageTemplate          = template.Must(template.ParseFS(templateFS, "templates/page.html")).Option("missingkey=error")
 	editPageTemplate      = template.Must(template.ParseFS(templateFS, "templates/editPage.html")).Option("missingkey=error")
 	richEditPageTemplate  = template.Must(template.ParseFS(templateFS, "templates/monaco.html")).Option("missingkey=error")
-	indexTemplate         = template.Must(template.ParseFS(templateFS, "templates/index.html")).Option("missingkey=error")
+	indexTemplate         = template.Must(template.New("index.html").Funcs(templateFuncs).ParseFS(templateFS, "templates/index.html")).Option("missingkey=error")
 	searchResultsTemplate = template.Must(template.ParseFS(templateFS, "templates/search-results.html")).Option("missingkey=error")
 	page404Template       = template.Must(template.ParseFS(templateFS, "templates/404.html")).Option("missingkey=error")
+	historyTemplate       = template.Must(template.ParseFS(templateFS, "templates/history.html")).Option("missingkey=error")
+	diffTemplate          = template.Must(template.ParseFS(templateFS, "templates/diff.html")).Option("missingkey=error")
+	moveTemplate          = template.Must(template.ParseFS(templateFS, "templates/move.html")).Option("missingkey=error")
+	tagsTemplate          = template.Must(template.New("tags.html").Funcs(templateFuncs).ParseFS(templateFS, "templates/tags.html")).Option("missingkey=error")
+	trashTemplate         = template.Must(template.ParseFS(templateFS, "templates/trash.html")).Option("missingkey=error")
+	conflictTemplate      = template.Must(template.ParseFS(templateFS, "templates/conflict.html")).Option("missingkey=error")
+	filesTemplate         = template.Must(template.ParseFS(templateFS, "templates/files.html")).Option("missingkey=error")
+	galleryTemplate       = template.Must(template.ParseFS(templateFS, "templates/gallery.html")).Option("missingkey=error")
+	loginTemplate         = template.Must(template.ParseFS(templateFS, "templates/login.html")).Option("missingkey=error")
+	passkeysTemplate      = template.Must(template.ParseFS(templateFS, "templates/passkeys.html")).Option("missingkey=error")
 )
 
+// templateFuncs are functions available to templates listing tags
+var templateFuncs = template.FuncMap{"tagQuery": tagQuery}
+
 var crlf = strings.NewReplacer("\r\n", "\n")
 
 // htmlEscaper is a copy of a non-exported html.htmlEscaper backing
@@ -606,22 +1335,61 @@ func withHeaders(h http.Handler, headers ...string) http.Handler {
 	})
 }
 
-func nonPublicHandler(h http.Handler) http.Handler {
-	rfc6598net := netip.MustParsePrefix("100.64.0.0/10")
+// hostHandler passes requests for the host to h, and all others to other
+func hostHandler(host string, h, other http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if strings.EqualFold(r.Host, host) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		other.ServeHTTP(w, r)
+	})
+}
+
+// accessHandler only passes requests from clients allowed by the policy to h.
+// Requests passed have RemoteAddr set to the address of the client behind
+// trusted proxies, and the X-Forwarded-Proto header set only if a trusted
+// proxy reported the protocol.
+func accessHandler(p *access.Policy, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, proto, err := p.Client(r)
 		if err != nil {
-			log.Printf("nonPublicHandler: getting host from %q: %v", r.RemoteAddr, err)
+			log.Printf("accessHandler: getting client address of request from %q: %v", r.RemoteAddr, err)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 			return
 		}
-		ip := addrPort.Addr()
-		switch {
-		default:
-			log.Printf("nonPublicHandler: refusing request from non-private IP %v", ip)
+		if !p.Allowed(ip) {
+			log.Printf("accessHandler: refusing request from %v", ip)
 			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-		case rfc6598net.Contains(ip) || ip.IsLoopback() || ip.IsPrivate():
-			h.ServeHTTP(w, r)
+			return
 		}
+		r = r.Clone(r.Context())
+		r.RemoteAddr = netip.AddrPortFrom(ip, 0).String()
+		if proto != "" {
+			r.Header.Set("X-Forwarded-Proto", proto)
+		} else {
+			r.Header.Del("X-Forwarded-Proto")
+		}
+		h.ServeHTTP(w, r)
 	})
 }
+
+// prefixList is a flag value holding a comma-separated list of CIDR ranges
+type prefixList []netip.Prefix
+
+func (l prefixList) String() string {
+	var s []string
+	for _, p := range l {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *prefixList) Set(s string) error {
+	v, err := access.ParsePrefixes(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
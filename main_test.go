@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -35,3 +39,60 @@ func Benchmark_noteTags(b *testing.B) {
 }
 
 var sink []string
+
+func Test_hostHandler(t *testing.T) {
+	files := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "files") })
+	notes := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "notes") })
+	h := hostHandler("files.notes.lan:8080", files, notes)
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"files.notes.lan:8080", "files"},
+		{"FILES.Notes.LAN:8080", "files"},
+		{"files.notes.lan", "notes"},
+		{"notes.lan:8080", "notes"},
+		{"", "notes"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/.files/h/a.png", nil)
+		r.Host = tc.host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("host %q: served by %q handler, want %q", tc.host, got, tc.want)
+		}
+	}
+}
+
+func Test_indexLinks(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	h := newHandler(db)
+	links := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRowContext(ctx, `SELECT count(*) FROM links`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// notes saved before the links table was created
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('a', 'A', 'See [[b]]')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.indexLinks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := links(); n != 1 {
+		t.Fatalf("got %d links after indexing, want 1", n)
+	}
+	// the notes are only indexed once, even if no links are left
+	if _, err := db.ExecContext(ctx, `DELETE FROM links`); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.indexLinks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := links(); n != 0 {
+		t.Fatalf("notes indexed again, got %d links", n)
+	}
+}
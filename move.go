@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errNoteExists is returned by moveNote if there's already a note at the
+// destination path
+var errNoteExists = errors.New("note already exists")
+
+func (h *handler) movePage(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimLeft(r.URL.Path, "/")
+	if p == "." || !fs.ValidPath(p) {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	var text string
+	switch err := h.stEditPage.QueryRowContext(r.Context(), sql.Named("path", p)).Scan(&text); err {
+	case nil:
+	case sql.ErrNoRows:
+		pageNotFound(w, r)
+		return
+	default:
+		log.Printf("move %q: %v", r.URL, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	moveTemplate.Execute(w, struct{ Path, Title string }{Path: p, Title: parseNote(text).Title})
+}
+
+func (h *handler) moveFromForm(w http.ResponseWriter, r *http.Request, from, to string) {
+	to = strings.TrimLeft(strings.TrimSpace(to), "/")
+	if to == "" || to == "." || !fs.ValidPath(to) || reservedPath(to) {
+		http.Error(w, "Invalid destination path", http.StatusBadRequest)
+		return
+	}
+	switch err := h.moveNote(r.Context(), from, to, r.PostForm.Get("rewrite") == "true"); err {
+	case nil:
+		http.Redirect(w, r, (&url.URL{Path: "/" + to}).String(), http.StatusSeeOther)
+	case sql.ErrNoRows:
+		pageNotFound(w, r)
+	case errNoteExists:
+		http.Error(w, "There is already a note at the destination path", http.StatusConflict)
+	default:
+		log.Printf("moving %q to %q: %v", from, to, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// moveNote changes note path from one to another, along with all the data
+// attached to it, and leaves a redirect at the old path. If rewrite is true,
+// links to the old path in other notes are updated to point to the new path.
+// It returns sql.ErrNoRows if there's no note at the old path, and
+// errNoteExists if the new path is already taken. Moving a note to its own
+// path changes nothing.
+func (h *handler) moveNote(ctx context.Context, from, to string, rewrite bool) error {
+	if from == to {
+		return h.stEditPage.QueryRowContext(ctx, sql.Named("path", from)).Scan(new(string))
+	}
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var text string
+	if err := tx.StmtContext(ctx, h.stEditPage).QueryRowContext(ctx, sql.Named("path", from)).Scan(&text); err != nil {
+		return err
+	}
+	switch err := tx.StmtContext(ctx, h.stEditPage).QueryRowContext(ctx, sql.Named("path", to)).Scan(new(string)); err {
+	case nil:
+		return errNoteExists
+	case sql.ErrNoRows:
+	default:
+		return err
+	}
+	// files reference notes by path, so foreign keys are only checked on
+	// commit, once all references are updated
+	if _, err := tx.ExecContext(ctx, `PRAGMA defer_foreign_keys=ON`); err != nil {
+		return err
+	}
+	for _, s := range [...]string{
+		`UPDATE notes SET Path=@to WHERE Path=@from`,
+		`UPDATE note_files SET NotePath=@to WHERE NotePath=@from`,
+		`UPDATE uploads SET NotePath=@to WHERE NotePath=@from`,
+		`UPDATE links SET Source=@to WHERE Source=@from`,
+		`UPDATE notes_history SET Path=@to WHERE Path=@from`,
+		`DELETE FROM redirects WHERE Path=@to`,
+		`UPDATE redirects SET Target=@to WHERE Target=@from`,
+		`INSERT INTO redirects(Path,Target) VALUES(@from,@to)`,
+	} {
+		if _, err := tx.ExecContext(ctx, s, sql.Named("from", from), sql.Named("to", to)); err != nil {
+			return err
+		}
+	}
+	// relative links of the moved note may now point elsewhere
+	if err := h.updateLinks(ctx, tx, to, text); err != nil {
+		return err
+	}
+	if !rewrite {
+		return tx.Commit()
+	}
+	type note struct{ path, text string }
+	var notes []note
+	rows, err := tx.QueryContext(ctx, `SELECT notes.Path, notes.Text FROM notes JOIN links ON notes.Path=links.Source
+		WHERE links.Target=@from`, sql.Named("from", from))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n note
+		if err := rows.Scan(&n.path, &n.text); err != nil {
+			return err
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if text := rewriteLinks(n.text, from, to); text != n.text {
+			if err := h.storeNote(ctx, tx, n.path, text); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// rewriteLinks replaces absolute markdown links and wiki links pointing to the
+// note at the old path with links to the new path. Relative links are left
+// intact.
+func rewriteLinks(text, from, to string) string {
+	if !strings.Contains(text, from) && !strings.Contains(text, (&url.URL{Path: from}).EscapedPath()) {
+		return text
+	}
+	const wikiEnd = "]|#"
+	text = replaceLinkTarget(text, "[[", from, to, wikiEnd)
+	text = replaceLinkTarget(text, "[[/", from, to, wikiEnd)
+	const linkEnd = ") \t\n#?>\""
+	escFrom, escTo := (&url.URL{Path: "/" + from}).EscapedPath(), (&url.URL{Path: "/" + to}).EscapedPath()
+	for _, prefix := range [...]string{"](", "](<", "]: ", "]: <"} {
+		text = replaceLinkTarget(text, prefix, escFrom, escTo, linkEnd)
+		if escFrom != "/"+from {
+			text = replaceLinkTarget(text, prefix, "/"+from, "/"+to, linkEnd)
+		}
+	}
+	return text
+}
+
+// replaceLinkTarget replaces all occurrences of prefix+from with prefix+to if
+// they're followed by one of the terminator bytes or the end of text.
+func replaceLinkTarget(text, prefix, from, to, terminators string) string {
+	needle := prefix + from
+	var b strings.Builder
+	for {
+		i := strings.Index(text, needle)
+		if i == -1 {
+			break
+		}
+		end := i + len(needle)
+		if end < len(text) && !strings.ContainsRune(terminators, rune(text[end])) {
+			b.WriteString(text[:end])
+			text = text[end:]
+			continue
+		}
+		b.WriteString(text[:i])
+		b.WriteString(prefix)
+		b.WriteString(to)
+		text = text[end:]
+	}
+	if b.Len() == 0 {
+		return text
+	}
+	b.WriteString(text)
+	return b.String()
+}
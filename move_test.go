@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_rewriteLinks(t *testing.T) {
+	const input = `See [[old/note]], [[old/note|label]], [[/old/note#part]],
+[link](/old/note), [other](/old/note-2), [titled](/old/note "Title"),
+[anchor](/old/note#section), [rel](note) and [ref].
+
+[ref]: /old/note
+`
+	const want = `See [[new note]], [[new note|label]], [[/new note#part]],
+[link](/new%20note), [other](/old/note-2), [titled](/new%20note "Title"),
+[anchor](/new%20note#section), [rel](note) and [ref].
+
+[ref]: /new%20note
+`
+	if got := rewriteLinks(input, "old/note", "new note"); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func Test_moveNoteSamePath(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '# Note')`); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	if err := h.moveNote(ctx, "note", "note", true); err != nil {
+		t.Fatalf("moving note to its own path: %v", err)
+	}
+	var redirects int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM redirects`).Scan(&redirects); err != nil || redirects != 0 {
+		t.Fatalf("got %d redirects, want none (%v)", redirects, err)
+	}
+	if err := h.moveNote(ctx, "missing", "missing", false); err != sql.ErrNoRows {
+		t.Fatalf("moving missing note to its own path: got %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func Test_moveToReservedPath(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '# Note')`); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	for _, to := range [...]string{".files/x", ".api/v1/x", ".tags", "/.trash"} {
+		r := httptest.NewRequest(http.MethodPost, "/note", strings.NewReader(url.Values{"rewrite": {"true"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.moveFromForm(w, r, "note", to)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("form move to %q: got %d, want %d", to, w.Code, http.StatusBadRequest)
+		}
+		body, err := json.Marshal(map[string]string{"From": "note", "To": to})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		h.apiMoveNote(w, httptest.NewRequest(http.MethodPost, "/.api/v1/move", bytes.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("API move to %q: got %d, want %d", to, w.Code, http.StatusBadRequest)
+		}
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM notes WHERE Path='note'`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("note moved: %d, %v", n, err)
+	}
+}
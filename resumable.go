@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads let the editor send large files in chunks and continue
+// interrupted uploads from the last received byte. The protocol is modeled
+// after tus.io:
+//
+//   - POST /.uploads with document, name and size form fields starts an
+//     upload and returns its URL in the Location header;
+//   - HEAD on the upload URL returns the number of bytes received so far in
+//     the Upload-Offset header;
+//   - PATCH on the upload URL with the Upload-Offset header appends request
+//     body to the upload. Once all bytes are received, the file is stored and
+//     the response is the same as for the POST /.files request;
+//   - DELETE on the upload URL cancels the upload.
+//
+// Chunks are appended to a file named after the upload ID in the uploads
+// directory, the database only keeps the upload metadata and the number of
+// bytes received. Uploads not completed within a day are discarded.
+
+// maxChunkSize limits the body size of a single PATCH request
+const maxChunkSize = 8 << 20
+
+func (h *handler) resumableUpload(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/.uploads" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.startUpload(w, r)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/.uploads/")
+	if !validUploadID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		var size, received int64
+		switch err := h.db.QueryRowContext(r.Context(), `SELECT Size, Received FROM uploads WHERE ID=@id`,
+			sql.Named("id", id)).Scan(&size, &received); err {
+		case nil:
+		case sql.ErrNoRows:
+			http.NotFound(w, r)
+			return
+		default:
+			log.Printf("upload %q: %v", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(received, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		h.continueUpload(w, r, id)
+	case http.MethodDelete:
+		if err := dropUpload(r.Context(), h.db, h.uploadsDir, id); err != nil {
+			log.Printf("upload %q: %v", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) startUpload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	notePath, ok := uploadNotePath(r.PostForm.Get("document"))
+	if !ok {
+		http.Error(w, "Invalid 'document' form field", http.StatusBadRequest)
+		return
+	}
+	filename, err := validateFilename(r.PostForm.Get("name"))
+	if err != nil {
+		http.Error(w, "Bad file name", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseInt(r.PostForm.Get("size"), 10, 64)
+	if err != nil || size <= 0 {
+		http.Error(w, "Invalid 'size' form field", http.StatusBadRequest)
+		return
+	}
+	if size > h.maxFileSize {
+		h.uploadFailed(w, errFileTooLarge{h.maxFileSize})
+		return
+	}
+	// file path is not known until the upload completes, so re-uploads of
+	// already attached files may be refused here
+	if err := h.checkNoteQuota(r.Context(), notePath, "", size); err != nil {
+		h.uploadFailed(w, err)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	id := base64.RawURLEncoding.EncodeToString(b)
+	if _, err := h.db.ExecContext(r.Context(), `INSERT INTO uploads(ID,NotePath,Name,Size,Type) VALUES(@id,@notepath,@name,@size,@type)`,
+		sql.Named("id", id),
+		sql.Named("notepath", notePath),
+		sql.Named("name", filename),
+		sql.Named("size", size),
+		sql.Named("type", nullString(r.PostForm.Get("type"))),
+	); err != nil {
+		log.Printf("starting upload: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/.uploads/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (h *handler) continueUpload(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+	var notePath, filename, contentType string
+	var size, received int64
+	switch err := h.db.QueryRowContext(ctx, `SELECT NotePath, Name, Size, Received, coalesce(Type,'') FROM uploads WHERE ID=@id`,
+		sql.Named("id", id)).Scan(&notePath, &filename, &size, &received, &contentType); err {
+	case nil:
+	case sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	default:
+		h.uploadFailed(w, err)
+		return
+	}
+	if offset != received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(received, 10))
+		http.Error(w, "Upload-Offset does not match the number of bytes received", http.StatusConflict)
+		return
+	}
+	if r.ContentLength > maxChunkSize {
+		http.Error(w, fmt.Sprintf("Chunk is larger than the %v limit", byteSize(maxChunkSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(http.MaxBytesReader(w, r.Body, maxChunkSize), size-received+1))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("Chunk is larger than the %v limit", byteSize(maxChunkSize)), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if int64(len(b)) > size-received {
+		http.Error(w, "Upload is larger than its declared size", http.StatusBadRequest)
+		return
+	}
+	if len(b) != 0 {
+		if received, err = appendChunk(ctx, h.db, h.uploadsDir, id, offset, b); err != nil {
+			if err == errOffsetMismatch {
+				http.Error(w, "Upload-Offset does not match the number of bytes received", http.StatusConflict)
+				return
+			}
+			h.uploadFailed(w, err)
+			return
+		}
+	}
+	if received < size {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(received, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	tf, err := openUpload(h.uploadsDir, id, size)
+	if err != nil {
+		h.uploadFailed(w, err)
+		return
+	}
+	defer tf.f.Close()
+	_, link, err := h.storeUpload(ctx, notePath, fileUpload{name: filename, contentType: contentType, tf: tf})
+	if err != nil {
+		var quotaErr errNoteQuota
+		var imageErr errBadImage
+		if errors.As(err, &quotaErr) || errors.As(err, &imageErr) {
+			dropUpload(ctx, h.db, h.uploadsDir, id)
+		}
+		// on other errors upload is kept, so that completing it can be
+		// retried with an empty PATCH request
+		h.uploadFailed(w, err)
+		return
+	}
+	if err := dropUpload(ctx, h.db, h.uploadsDir, id); err != nil {
+		log.Printf("upload %q: %v", id, err)
+	}
+	writeUploadLink(w, link)
+}
+
+// errOffsetMismatch is returned by appendChunk if another chunk was stored at
+// the same offset concurrently
+var errOffsetMismatch = errors.New("upload offset mismatch")
+
+// validUploadID reports whether id has the form of IDs made by startUpload,
+// so that it can be used as a file name
+func validUploadID(id string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil && len(b) == 16
+}
+
+// appendChunk writes b to the upload file in dir at offset and returns the new
+// number of bytes received. The file is written while the database
+// transaction holds the write lock, so concurrent requests for the same
+// offset can't both write to it.
+func appendChunk(ctx context.Context, db *sql.DB, dir, id string, offset int64, b []byte) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE uploads SET Received=Received+@n WHERE ID=@id AND Received=@offset`,
+		sql.Named("id", id), sql.Named("offset", offset), sql.Named("n", len(b)))
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, errOffsetMismatch
+	}
+	f, err := os.OpenFile(filepath.Join(dir, id), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteAt(b, offset); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return offset + int64(len(b)), tx.Commit()
+}
+
+// openUpload opens the file of the completed upload in dir. Bytes past size,
+// left by writes that weren't committed, are ignored.
+func openUpload(dir, id string, size int64) (*tempFile, error) {
+	f, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		return nil, err
+	}
+	tf := &tempFile{f: f, size: size, sum: sha1.New()}
+	if _, err := io.Copy(tf.sum, io.NewSectionReader(f, 0, size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return tf, nil
+}
+
+func dropUpload(ctx context.Context, db *sql.DB, dir, id string) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM uploads WHERE ID=@id`, sql.Named("id", id)); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// dropStaleUploads removes uploads started more than a day ago, and files in
+// dir not changed for a day that belong to no upload, like the ones of
+// uploads to deleted notes
+func dropStaleUploads(ctx context.Context, db *sql.DB, dir string) error {
+	rows, err := db.QueryContext(ctx, `DELETE FROM uploads WHERE Ctime < strftime('%s','now')-86400 RETURNING ID`)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, id)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range stale {
+		if err := os.Remove(filepath.Join(dir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !e.Type().IsRegular() || time.Since(info.ModTime()) < 24*time.Hour {
+			continue
+		}
+		var exists bool
+		if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM uploads WHERE ID=@id)`,
+			sql.Named("id", e.Name())).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropStaleUploadsLoop periodically removes stale uploads
+func (h *handler) dropStaleUploadsLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := dropStaleUploads(ctx, h.db, h.uploadsDir); err != nil && ctx.Err() == nil {
+			log.Printf("removing stale uploads: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
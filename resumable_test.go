@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+)
+
+func Test_resumableUpload(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '')`); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	h.blobs = blobs
+	h.maxFileSize = 1 << 20
+	h.uploadsDir = t.TempDir()
+	const data = "first chunk, second chunk"
+
+	form := url.Values{"document": {"http://notes.lan/note"}, "name": {"a.txt"}, "size": {strconv.Itoa(len(data))}}
+	r := httptest.NewRequest(http.MethodPost, "/.uploads", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.resumableUpload(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("starting upload: got %d %q", w.Code, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	id := strings.TrimPrefix(loc, "/.uploads/")
+	patch := func(offset int, chunk string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPatch, loc, strings.NewReader(chunk))
+		r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		w := httptest.NewRecorder()
+		h.resumableUpload(w, r)
+		return w
+	}
+	if w := patch(0, data[:13]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "13" {
+		t.Fatalf("first chunk: got %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	if w := patch(0, data[:13]); w.Code != http.StatusConflict {
+		t.Fatalf("chunk at a wrong offset: got %d", w.Code)
+	}
+	var inDB int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM uploads WHERE ID=?`, id).Scan(&inDB); err != nil || inDB != 1 {
+		t.Fatalf("got %d uploads, %v", inDB, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(h.uploadsDir, id)); err != nil || string(b) != data[:13] {
+		t.Fatalf("upload file: got %q, %v", b, err)
+	}
+	if w := patch(13, data[13:]); w.Code != http.StatusOK {
+		t.Fatalf("last chunk: got %d %q", w.Code, w.Body)
+	}
+	var hash string
+	if err := db.QueryRowContext(ctx, `SELECT files.Hash FROM files JOIN note_files ON files.Path=note_files.Path
+		WHERE note_files.NotePath='note'`).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := blobs.Get(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || string(b) != data {
+		t.Fatalf("stored file: got %q, %v", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(h.uploadsDir, id)); !os.IsNotExist(err) {
+		t.Fatalf("upload file left after completion: %v", err)
+	}
+
+	r = httptest.NewRequest(http.MethodDelete, "/.uploads/..%2Fnotes.sqlite", nil)
+	w = httptest.NewRecorder()
+	h.resumableUpload(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("invalid upload ID: got %d", w.Code)
+	}
+}
+
+func Test_dropStaleUploads(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '');
+		INSERT INTO uploads(ID, NotePath, Name, Size, Ctime) VALUES
+			('stale', 'note', 'a.txt', 10, strftime('%s','now')-2*86400),
+			('fresh', 'note', 'b.txt', 10, strftime('%s','now'))`); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range [...]string{"stale", "fresh", "orphan", "recent-orphan"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if name != "recent-orphan" {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := dropStaleUploads(ctx, db, dir); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	if got, want := strings.Join(left, ","), "fresh,recent-orphan"; got != want {
+		t.Fatalf("files left: got %q, want %q", got, want)
+	}
+	var ids []string
+	rows, err := db.QueryContext(ctx, `SELECT ID FROM uploads`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if got := strings.Join(ids, ","); got != "fresh" {
+		t.Fatalf("uploads left: got %q, want %q", got, "fresh")
+	}
+}
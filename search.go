@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+	"github.com/artyom/notes-server/internal/plaintext"
+	"modernc.org/sqlite"
+)
+
+// errInvalidQuery is wrapped by errors from parseSearchQuery
+var errInvalidQuery = errors.New("invalid search query")
+
+// searchQuery is a parsed search query. Its free text part is passed to FTS5
+// as is, while qualifiers filter notes by their other properties:
+//
+//	tag:name      note has this tag, -tag:name excludes notes with it
+//	path:prefix   note path starts with prefix
+//	title:text    note title contains text, case-insensitively
+//	after:date    note was modified on or after date
+//	before:date   note was modified before date
+//
+// Qualifiers other than dates can be negated with the "-" prefix. Values with
+// spaces can be put in double quotes: tag:"two words".
+type searchQuery struct {
+	Text          string // FTS5 query
+	Exclude       string // FTS5 query matching notes to leave out
+	Tags, NotTags []string
+	Paths         []string // any of these prefixes must match
+	NotPaths      []string
+	Titles        []string
+	NotTitles     []string
+	After, Before time.Time
+
+	filters []string // qualifiers as written in the query
+}
+
+func parseSearchQuery(q string) (searchQuery, error) {
+	var out searchQuery
+	var text []string
+	for _, tok := range splitQuery(q) {
+		name, value, ok := strings.Cut(tok, ":")
+		negate := strings.HasPrefix(name, "-")
+		name = strings.ToLower(strings.TrimPrefix(name, "-"))
+		if !ok || value == "" || !isQualifier(name) {
+			text = append(text, tok)
+			continue
+		}
+		out.filters = append(out.filters, tok)
+		value = unquote(value)
+		switch name {
+		case "tag":
+			if negate {
+				out.NotTags = append(out.NotTags, value)
+			} else {
+				out.Tags = append(out.Tags, value)
+			}
+		case "path":
+			value = strings.TrimLeft(value, "/")
+			if negate {
+				out.NotPaths = append(out.NotPaths, value)
+			} else {
+				out.Paths = append(out.Paths, value)
+			}
+		case "title":
+			if negate {
+				out.NotTitles = append(out.NotTitles, value)
+			} else {
+				out.Titles = append(out.Titles, value)
+			}
+		case "after", "before":
+			if negate {
+				return out, fmt.Errorf("%w: %s: cannot be negated", errInvalidQuery, name)
+			}
+			t, err := parseQueryDate(value)
+			if err != nil {
+				return out, fmt.Errorf("%w: %s: %q is not a date, use YYYY-MM-DD, YYYY-MM or YYYY", errInvalidQuery, name, value)
+			}
+			if name == "after" {
+				out.After = t
+			} else {
+				out.Before = t
+			}
+		}
+	}
+	out.Text = strings.Join(text, " ")
+	return out, nil
+}
+
+func isQualifier(name string) bool {
+	switch name {
+	case "tag", "path", "title", "after", "before":
+		return true
+	}
+	return false
+}
+
+// splitQuery splits search query on spaces outside of double quotes
+func splitQuery(q string) []string {
+	var out []string
+	var quoted bool
+	start := -1
+	for i, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case unicode.IsSpace(r) && !quoted:
+			if start != -1 {
+				out = append(out, q[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start == -1 {
+			start = i
+		}
+	}
+	if start != -1 {
+		out = append(out, q[start:])
+	}
+	return out
+}
+
+// unquote removes double quotes around s, if any, unescaping doubled quotes
+// inside, as FTS5 does
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+}
+
+// tagQuery returns search query matching notes with the tag
+func tagQuery(tag string) string {
+	return `tag:"` + strings.ReplaceAll(tag, `"`, `""`) + `"`
+}
+
+// parseQueryDate parses date in local time, the precision can be a day, a
+// month, or a year
+func parseQueryDate(s string) (time.Time, error) {
+	var err error
+	for _, layout := range [...]string{"2006-01-02", "2006-01", "2006"} {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// sql returns SQL query with its arguments selecting title, path, tags and
+// search snippet of the matching notes. Free text is matched against the
+// given full text search table, either notes_fts or notes_trigram. If limit is
+// positive, at most that many best matching notes are selected.
+func (q searchQuery) sql(table string, limit int) (string, []any) {
+	var conds []string
+	var args []any
+	if q.Text != "" {
+		conds = append(conds, table+` MATCH ?`)
+		args = append(args, q.Text)
+	}
+	if q.Exclude != "" {
+		conds = append(conds, `notes.rowid NOT IN (SELECT rowid FROM notes_fts WHERE notes_fts MATCH ?)`)
+		args = append(args, q.Exclude)
+	}
+	conds, args = q.noteConds(conds, args)
+	where := strings.Join(conds, ` AND `)
+	if q.Text == "" {
+		return `SELECT Title, Path, Tags, '' FROM notes WHERE ` + where + ` ORDER BY Mtime DESC`, args
+	}
+	query := `SELECT notes.Title, notes.Path, notes.Tags, snippet(` + table + `, 2, '<ftsMark>', '</ftsMark>', '...', 20)
+		FROM ` + table + ` JOIN notes ON notes.rowid=` + table + `.rowid WHERE ` + where + ` ORDER BY rank`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	return query, args
+}
+
+// noteConds appends SQL conditions on columns of the notes table made from
+// the query qualifiers, and their arguments, to conds and args
+func (q searchQuery) noteConds(conds []string, args []any) ([]string, []any) {
+	const hasTag = `EXISTS(SELECT 1 FROM json_each(notes.Tags) WHERE json_each.value=?)`
+	for _, tag := range q.Tags {
+		conds = append(conds, hasTag)
+		args = append(args, tag)
+	}
+	for _, tag := range q.NotTags {
+		conds = append(conds, `NOT `+hasTag)
+		args = append(args, tag)
+	}
+	const hasPrefix = `substr(notes.Path,1,?)=?`
+	if len(q.Paths) != 0 {
+		var ors []string
+		for _, p := range q.Paths {
+			ors = append(ors, hasPrefix)
+			args = append(args, utf8.RuneCountInString(p), p)
+		}
+		conds = append(conds, `(`+strings.Join(ors, ` OR `)+`)`)
+	}
+	for _, p := range q.NotPaths {
+		conds = append(conds, `NOT `+hasPrefix)
+		args = append(args, utf8.RuneCountInString(p), p)
+	}
+	const hasTitle = `instr(lower(notes.Title),lower(?))>0`
+	for _, s := range q.Titles {
+		conds = append(conds, hasTitle)
+		args = append(args, s)
+	}
+	for _, s := range q.NotTitles {
+		conds = append(conds, `NOT `+hasTitle)
+		args = append(args, s)
+	}
+	if !q.After.IsZero() {
+		conds = append(conds, `notes.Mtime>=?`)
+		args = append(args, q.After.Unix())
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, `notes.Mtime<?`)
+		args = append(args, q.Before.Unix())
+	}
+	return conds, args
+}
+
+// searchResult holds notes found by searchNotes
+type searchResult struct {
+	Entries []indexEntry
+	// Files hold uploaded files with matching text
+	Files []fileMatch
+	// Rewritten is the search term that was used instead of the original
+	// one, which had invalid syntax
+	Rewritten string
+	// Approximate is set if nothing matched the search term, and Entries
+	// hold notes with similar words
+	Approximate bool
+}
+
+// searchNotes returns notes matching the search term. Unless advanced is true,
+// free text that is not a valid FTS5 query is searched for once again with
+// every word quoted. Queries made of plain words also match them as
+// substrings of longer words, using the trigram index; if nothing matches at
+// all, notes with similar words are looked up as a fallback.
+func searchNotes(ctx context.Context, db *sql.DB, term string, advanced bool) (searchResult, error) {
+	var res searchResult
+	if term == "" {
+		return res, errors.New("empty search term")
+	}
+	q, err := parseSearchQuery(term)
+	if err != nil {
+		return res, err
+	}
+	entries, err := runSearch(ctx, db, q, "notes_fts", 0)
+	if err != nil && !advanced && q.Text != "" && isSyntaxError(err) {
+		var excluded []string
+		q.Text, excluded = quoteFTS(q.Text)
+		q.Exclude = strings.Join(excluded, " OR ")
+		var terms []string
+		if q.Text != "" {
+			terms = append(terms, q.Text)
+		}
+		for _, s := range excluded {
+			terms = append(terms, "-"+s)
+		}
+		res.Rewritten = strings.Join(append(terms, q.filters...), " ")
+		entries, err = runSearch(ctx, db, q, "notes_fts", 0)
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Entries = entries
+	if q.Text != "" {
+		if res.Files, err = searchFiles(ctx, db, q); err != nil {
+			return res, err
+		}
+	}
+	words := plainWords(q.Text)
+	if advanced || len(words) == 0 {
+		return res, nil
+	}
+	if sq := substringQuery(words); sq != "" {
+		tq := q
+		tq.Text = sq
+		more, err := runSearch(ctx, db, tq, "notes_trigram", 0)
+		if err != nil {
+			return res, err
+		}
+		res.Entries = mergeResults(res.Entries, more)
+	}
+	if len(res.Entries) != 0 || len(res.Files) != 0 {
+		return res, nil
+	}
+	if fq := fuzzyQuery(words); fq != "" {
+		tq := q
+		tq.Text = fq
+		const maxResults = 10
+		if res.Entries, err = runSearch(ctx, db, tq, "notes_trigram", maxResults); err != nil {
+			return res, err
+		}
+		res.Approximate = len(res.Entries) != 0
+	}
+	return res, nil
+}
+
+// plainWords returns words of the free text search query, unless it uses any
+// FTS5 syntax other than double quotes
+func plainWords(text string) []string {
+	var out []string
+	for _, tok := range splitQuery(text) {
+		switch {
+		case len(tok) > 1 && tok[0] == '"' && tok[len(tok)-1] == '"':
+			tok = unquote(tok)
+		case strings.ContainsAny(tok, `"-+*:^(){}`):
+			return nil
+		case tok == "AND" || tok == "OR" || tok == "NOT" || tok == "NEAR":
+			return nil
+		}
+		out = append(out, tok)
+	}
+	return out
+}
+
+// substringQuery returns trigram index query matching notes that contain all
+// the words, possibly as parts of longer words. It returns an empty string if
+// any word is too short for the trigram index.
+func substringQuery(words []string) string {
+	var terms []string
+	for _, w := range words {
+		if utf8.RuneCountInString(w) < 3 {
+			return ""
+		}
+		terms = append(terms, `"`+strings.ReplaceAll(w, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// fuzzyQuery returns trigram index query matching notes that have any of the
+// trigrams of the words. Ranking of the results favors notes sharing more of
+// them, which makes it tolerant to typos.
+func fuzzyQuery(words []string) string {
+	var terms []string
+	seen := make(map[string]struct{})
+	for _, w := range words {
+		r := []rune(strings.ToLower(w))
+		for i := 0; i+3 <= len(r); i++ {
+			t := string(r[i : i+3])
+			if strings.TrimSpace(t) != t {
+				continue
+			}
+			if _, ok := seen[t]; ok {
+				continue
+			}
+			seen[t] = struct{}{}
+			terms = append(terms, `"`+strings.ReplaceAll(t, `"`, `""`)+`"`)
+		}
+	}
+	return strings.Join(terms, " OR ")
+}
+
+// mergeResults merges ranked lists of search results using reciprocal rank
+// fusion, so that notes found by several searches come first. Entries found
+// earlier take precedence over the same notes found later.
+func mergeResults(lists ...[]indexEntry) []indexEntry {
+	const k = 60 // dampens the impact of top ranks, as suggested by the original paper
+	scores := make(map[string]float64)
+	var out []indexEntry
+	for _, list := range lists {
+		for i, ent := range list {
+			if _, ok := scores[ent.Path]; !ok {
+				out = append(out, ent)
+			}
+			scores[ent.Path] += 1 / float64(k+i+1)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return scores[out[i].Path] > scores[out[j].Path] })
+	return out
+}
+
+// isSyntaxError reports whether err is caused by invalid search query syntax
+func isSyntaxError(err error) bool {
+	var se *sqlite.Error
+	return errors.As(err, &se) && se.Code() == 1 || errors.Is(err, errInvalidQuery)
+}
+
+// quoteFTS turns free text into a valid FTS5 query matching all of its words,
+// putting each of them in double quotes. Words prefixed with "-" are excluded
+// from results with the NOT operator. If there's nothing else to search, the
+// query is empty and the quoted words to exclude are returned instead, as FTS5
+// has no unary NOT.
+func quoteFTS(text string) (query string, excluded []string) {
+	var terms []string
+	for _, tok := range splitQuery(text) {
+		neg := len(tok) > 1 && tok[0] == '-'
+		if neg {
+			tok = tok[1:]
+		}
+		var prefix bool
+		if len(tok) > 1 && tok[len(tok)-1] == '*' {
+			prefix, tok = true, tok[:len(tok)-1]
+		}
+		s := `"` + strings.ReplaceAll(unquote(tok), `"`, `""`) + `"`
+		if prefix {
+			s += "*"
+		}
+		if neg {
+			excluded = append(excluded, s)
+		} else {
+			terms = append(terms, s)
+		}
+	}
+	if len(terms) == 0 {
+		return "", excluded
+	}
+	for _, s := range excluded {
+		terms = append(terms, "NOT", s)
+	}
+	return strings.Join(terms, " "), nil
+}
+
+// fileMatch is an uploaded file found by searchFiles
+type fileMatch struct {
+	Path    string
+	Notes   []noteTitle // notes the file is attached to
+	Snippet template.HTML
+}
+
+func (f fileMatch) Name() string { return path.Base(f.Path) }
+
+// searchFiles returns uploaded files with text matching the free text part of
+// the query, attached to notes matching its qualifiers, best matches first.
+// Queries files_fts can't run, like ones with filters on columns only notes
+// have, match no files.
+func searchFiles(ctx context.Context, db *sql.DB, q searchQuery) ([]fileMatch, error) {
+	out, err := queryFiles(ctx, db, q)
+	if err != nil && isSyntaxError(err) {
+		return nil, nil
+	}
+	return out, err
+}
+
+func queryFiles(ctx context.Context, db *sql.DB, q searchQuery) ([]fileMatch, error) {
+	conds, args := q.noteConds([]string{`files_fts MATCH ?`}, []any{q.Text})
+	rows, err := db.QueryContext(ctx, `SELECT files.Path, notes.Path, notes.Title,
+		snippet(files_fts, 1, '<ftsMark>', '</ftsMark>', '...', 20)
+		FROM files_fts JOIN files ON files.Hash=files_fts.Hash AND files.Original IS NULL
+		JOIN note_files ON note_files.Path=files.Path JOIN notes ON notes.Path=note_files.NotePath
+		WHERE `+strings.Join(conds, ` AND `)+` ORDER BY rank, files.Path, notes.Path`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []fileMatch
+	seen := make(map[string]int) // file path to its index in out
+	for rows.Next() {
+		var fPath, snippet string
+		var note noteTitle
+		if err := rows.Scan(&fPath, &note.Path, &note.Title, &snippet); err != nil {
+			return nil, err
+		}
+		i, ok := seen[fPath]
+		if !ok {
+			i = len(out)
+			seen[fPath] = i
+			out = append(out, fileMatch{Path: fPath, Snippet: template.HTML(htmlEscaper.Replace(snippet))})
+		}
+		out[i].Notes = append(out[i].Notes, note)
+	}
+	return out, rows.Err()
+}
+
+// maxIndexedText is the number of bytes of an uploaded file read for its full
+// text search index
+const maxIndexedText = 1 << 20
+
+// indexFileText adds text of the uploaded file with the given content hash to
+// the files_fts table, unless it's already there
+func indexFileText(ctx context.Context, db *sql.DB, hash, fileType string, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxIndexedText))
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO files_fts(Hash, "Text") SELECT @hash, @text
+		WHERE NOT EXISTS(SELECT 1 FROM files_fts WHERE Hash=@hash)`,
+		sql.Named("hash", hash), sql.Named("text", plaintext.Extract(fileType, b)))
+	return err
+}
+
+// indexFilesText adds text of files uploaded before the files_fts table was
+// added to it
+func indexFilesText(ctx context.Context, db *sql.DB, blobs blobstore.Store) error {
+	rows, err := db.QueryContext(ctx, `SELECT Hash, min(Type) FROM files
+		WHERE Original IS NULL AND Type IS NOT NULL AND Hash NOT IN (SELECT Hash FROM files_fts)
+		GROUP BY Hash`)
+	if err != nil {
+		return err
+	}
+	types := make(map[string]string)
+	for rows.Next() {
+		var hash, fileType string
+		if err := rows.Scan(&hash, &fileType); err != nil {
+			rows.Close()
+			return err
+		}
+		if plaintext.Indexable(fileType) {
+			types[hash] = fileType
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for hash, fileType := range types {
+		f, err := blobs.Get(ctx, hash)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				log.Printf("indexing text of uploaded files: %v", err)
+				continue
+			}
+			return err
+		}
+		err = indexFileText(ctx, db, hash, fileType, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runSearch(ctx context.Context, db *sql.DB, q searchQuery, table string, limit int) ([]indexEntry, error) {
+	query, args := q.sql(table, limit)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []indexEntry
+	var tagsJson []byte
+	for rows.Next() {
+		var ent indexEntry
+		var snippet string
+		tagsJson = tagsJson[:0]
+		if err := rows.Scan(&ent.Title, &ent.Path, &tagsJson, &snippet); err != nil {
+			return nil, err
+		}
+		if len(tagsJson) != 0 {
+			_ = json.Unmarshal(tagsJson, &ent.Tags)
+		}
+		ent.Snippet = template.HTML(htmlEscaper.Replace(snippet))
+		out = append(out, ent)
+	}
+	return out, rows.Err()
+}
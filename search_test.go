@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+)
+
+func Test_parseSearchQuery(t *testing.T) {
+	got, err := parseSearchQuery(`deploy tag:work -tag:"old stuff" path:/projects/ title:Plan after:2023-05 "exact phrase" Tags:x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := searchQuery{
+		Text:    `deploy "exact phrase" Tags:x`,
+		Tags:    []string{"work"},
+		NotTags: []string{"old stuff"},
+		Paths:   []string{"projects/"},
+		Titles:  []string{"Plan"},
+		After:   time.Date(2023, 5, 1, 0, 0, 0, 0, time.Local),
+		filters: []string{`tag:work`, `-tag:"old stuff"`, `path:/projects/`, `title:Plan`, `after:2023-05`},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got:\n%+v\nwant:\n%+v", got, want)
+	}
+	for _, q := range []string{"before:yesterday", "-after:2023"} {
+		if _, err := parseSearchQuery(q); err == nil {
+			t.Errorf("parseSearchQuery(%q) did not fail", q)
+		}
+	}
+}
+
+func Test_tagQuery(t *testing.T) {
+	for _, tag := range []string{"work", "two words", `say "hi"`} {
+		q, err := parseSearchQuery(tagQuery(tag))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(q.Tags) != 1 || q.Tags[0] != tag || q.Text != "" {
+			t.Errorf("tagQuery(%q) is parsed as %+v", tag, q)
+		}
+	}
+}
+
+func Test_quoteFTS(t *testing.T) {
+	for _, tc := range []struct {
+		input, want string
+		excluded    []string
+	}{
+		{`foo-bar baz:qux`, `"foo-bar" "baz:qux"`, nil},
+		{`deploy -staging pre*`, `"deploy" "pre"* NOT "staging"`, nil},
+		{`"exact phrase" say "hi`, `"exact phrase" "say" """hi"`, nil},
+		{`-alone`, ``, []string{`"alone"`}},
+		{`-one -two`, ``, []string{`"one"`, `"two"`}},
+	} {
+		got, excluded := quoteFTS(tc.input)
+		if got != tc.want || !reflect.DeepEqual(excluded, tc.excluded) {
+			t.Errorf("quoteFTS(%q) = %q, %q, want %q, %q", tc.input, got, excluded, tc.want, tc.excluded)
+		}
+	}
+}
+
+func Test_plainWords(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  []string
+	}{
+		{`Handler "two words"`, []string{"Handler", "two words"}},
+		{`foo OR bar`, nil},
+		{`prefix*`, nil},
+		{`Title:foo`, nil},
+	} {
+		if got := plainWords(tc.input); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("plainWords(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func Test_fuzzyQuery(t *testing.T) {
+	const want = `"dep" OR "epl" OR "ply" OR "lyo"`
+	if got := fuzzyQuery([]string{"Deplyo", "ep"}); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func Test_mergeResults(t *testing.T) {
+	words := []indexEntry{{Path: "a", Snippet: "word"}, {Path: "b"}}
+	substrings := []indexEntry{{Path: "c"}, {Path: "b"}, {Path: "a", Snippet: "substring"}}
+	got := mergeResults(words, substrings)
+	var paths []string
+	for _, ent := range got {
+		paths = append(paths, ent.Path)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("got %q, want %q", paths, want)
+	}
+	if got[0].Snippet != "word" {
+		t.Fatalf("snippet of the first search was not kept: %q", got[0].Snippet)
+	}
+}
+
+func Test_searchNotesColumnFilter(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	for _, s := range [...]string{
+		`INSERT INTO notes(Path, Title, Text, Tags) VALUES('report', 'Report', 'quarterly report', '["work"]')`,
+		`INSERT INTO files(Path, Hash, Size, Type) VALUES('.files/h1/report.txt', 'h1', 6, 'text/plain')`,
+		`INSERT INTO note_files(NotePath, Path) VALUES('report', '.files/h1/report.txt')`,
+		`INSERT INTO files_fts(Hash, "Text") VALUES('h1', 'work report')`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := searchNotes(ctx, db, "Tags:work", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Path != "report" || len(res.Files) != 0 {
+		t.Fatalf("Tags:work: got %+v", res)
+	}
+	if res, err = searchNotes(ctx, db, "work", false); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.Files[0].Path != ".files/h1/report.txt" {
+		t.Fatalf("work: got files %+v", res.Files)
+	}
+}
+
+func Test_searchNotesExcludedOnly(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text, Tags) VALUES
+		('prod', 'Prod', 'deploy to production', '["work"]'),
+		('staging', 'Staging', 'deploy to staging', '["work"]'),
+		('home', 'Home', 'garden', '["home"]')`); err != nil {
+		t.Fatal(err)
+	}
+	res, err := searchNotes(ctx, db, "tag:work -staging", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].Path != "prod" {
+		t.Fatalf("got %+v", res.Entries)
+	}
+	if want := `-"staging" tag:work`; res.Rewritten != want {
+		t.Fatalf("got rewritten query %q, want %q", res.Rewritten, want)
+	}
+}
+
+// openTestDB returns a new database with the schema set up
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notes.sqlite")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	ctx := context.Background()
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initSchema(ctx, db, blobs); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func Test_searchNotesPathNonASCII(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES
+		('заметки/one', 'One', 'plan'),
+		('заметки/two', 'Two', 'plan'),
+		('other/three', 'Three', 'plan')`); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"plan path:заметки/", []string{"заметки/one", "заметки/two"}},
+		{"plan path:/заметки/one", []string{"заметки/one"}},
+		{"plan -path:заметки/", []string{"other/three"}},
+	} {
+		res, err := searchNotes(ctx, db, tc.query, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range res.Entries {
+			got = append(got, e.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.query, got, tc.want)
+		}
+	}
+}
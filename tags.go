@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errBadTag is returned by renameTag if the new tag name cannot be stored in
+// a tags comment
+var errBadTag = errors.New("invalid tag name")
+
+func (h *handler) tagsPage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		h.tagsAction(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	tags, err := allTags(r.Context(), h.stTags)
+	if err != nil {
+		log.Printf("tags: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	tagsTemplate.Execute(w, tags)
+}
+
+func (h *handler) tagsAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tag := r.PostForm.Get("tag")
+	if tag == "" {
+		http.Error(w, "Missing tag", http.StatusBadRequest)
+		return
+	}
+	var to string
+	if r.PostForm.Get("delete") != "true" {
+		if to = strings.TrimSpace(r.PostForm.Get("to")); to == "" {
+			http.Error(w, "Missing new tag name", http.StatusBadRequest)
+			return
+		}
+	}
+	switch _, err := h.renameTag(r.Context(), tag, to); err {
+	case nil:
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	case errBadTag:
+		http.Error(w, "Tag names cannot contain commas, line breaks or “-->”", http.StatusBadRequest)
+	default:
+		log.Printf("renaming tag %q to %q: %v", tag, to, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// renameTag rewrites tags comment of every note tagged with the from tag,
+// replacing it with the to tag. If the note already has the to tag, tags are
+// merged. If to is empty, the tag is removed. It returns the number of notes
+// updated.
+func (h *handler) renameTag(ctx context.Context, from, to string) (int, error) {
+	if to != "" && !validTag(to) {
+		return 0, errBadTag
+	}
+	if from == to {
+		return 0, nil
+	}
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	type note struct{ path, text string }
+	var notes []note
+	rows, err := tx.QueryContext(ctx, `SELECT Path, Text FROM notes
+		WHERE EXISTS(SELECT 1 FROM json_each(notes.Tags) WHERE json_each.value=@tag)`, sql.Named("tag", from))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n note
+		if err := rows.Scan(&n.path, &n.text); err != nil {
+			return 0, err
+		}
+		notes = append(notes, n)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var updated int
+	for _, n := range notes {
+		text, ok1 := replaceFrontMatterTag(n.text, from, to)
+		text, ok2 := replaceTag(text, from, to)
+		if !ok1 && !ok2 {
+			continue
+		}
+		if err := h.storeNote(ctx, tx, n.path, text); err != nil {
+			return 0, err
+		}
+		updated++
+	}
+	return updated, tx.Commit()
+}
+
+func validTag(tag string) bool {
+	return tag == strings.TrimSpace(tag) && tag != "" &&
+		!strings.ContainsAny(tag, ",\r\n") && !strings.Contains(tag, "-->")
+}
+
+// replaceTag rewrites the tags line parsed by noteTags, replacing the from tag
+// with the to tag, or removing it if to is empty. Tags comment that has
+// nothing but tags is removed altogether once it has no tags left. It reports
+// whether the text was changed.
+func replaceTag(text, from, to string) (string, bool) {
+	const prefix = `<!--`
+	const suffix = `-->`
+	const tagsWord = "Tags:"
+	start := strings.Index(text, prefix)
+	if start == -1 {
+		return text, false
+	}
+	end := strings.Index(text, suffix)
+	if end == -1 || end < start+len(prefix) {
+		return text, false
+	}
+	i := strings.Index(text[start+len(prefix):end], tagsWord)
+	if i == -1 {
+		return text, false
+	}
+	listStart := start + len(prefix) + i + len(tagsWord)
+	listEnd := end
+	if j := strings.IndexByte(text[listStart:end], '\n'); j != -1 {
+		listEnd = listStart + j
+	}
+	list := text[listStart:listEnd]
+	var found bool
+	var tags []string
+	seen := make(map[string]struct{})
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if s == from {
+			found = true
+			if s = to; s == "" {
+				continue
+			}
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		tags = append(tags, s)
+	}
+	if !found {
+		return text, false
+	}
+	if len(tags) == 0 && strings.TrimSpace(text[start+len(prefix):listStart-len(tagsWord)]) == "" &&
+		strings.TrimSpace(text[listEnd:end]) == "" {
+		rest := text[end+len(suffix):]
+		if strings.HasPrefix(rest, "\r\n") {
+			rest = rest[2:]
+		} else if strings.HasPrefix(rest, "\n") {
+			rest = rest[1:]
+		}
+		return text[:start] + rest, true
+	}
+	lead := list[:len(list)-len(strings.TrimLeft(list, " \t"))]
+	trail := list[len(strings.TrimRight(list, " \t\r")):]
+	switch {
+	case len(tags) == 0:
+		lead = ""
+	case lead == "":
+		lead = " "
+	}
+	return text[:listStart] + lead + strings.Join(tags, ", ") + trail + text[listEnd:], true
+}
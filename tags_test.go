@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func Test_replaceTag(t *testing.T) {
+	for _, tc := range []struct {
+		text, from, to, want string
+	}{
+		{"# Note\n<!-- Tags: a, b, c -->\ntext", "b", "d", "# Note\n<!-- Tags: a, d, c -->\ntext"},
+		{"# Note\n<!-- Tags: a, b, c -->\ntext", "b", "a", "# Note\n<!-- Tags: a, c -->\ntext"},
+		{"# Note\n<!-- Tags: a, b -->\ntext", "a", "", "# Note\n<!-- Tags: b -->\ntext"},
+		{"# Note\n<!-- Tags: a -->\ntext", "a", "", "# Note\ntext"},
+		{"# Note\n<!--\n\tTags: a,b\n\tMore text.\n-->\ntext", "a", "c", "# Note\n<!--\n\tTags: c, b\n\tMore text.\n-->\ntext"},
+		{"# Note\n<!--\n\tTags: a\n\tMore text.\n-->\ntext", "a", "", "# Note\n<!--\n\tTags:\n\tMore text.\n-->\ntext"},
+		{"# Note\n<!-- Tags: a -->\n<!-- Tags: b -->", "b", "c", "# Note\n<!-- Tags: a -->\n<!-- Tags: b -->"},
+	} {
+		got, changed := replaceTag(tc.text, tc.from, tc.to)
+		if got != tc.want {
+			t.Errorf("replaceTag(%q, %q, %q):\ngot:  %q\nwant: %q", tc.text, tc.from, tc.to, got, tc.want)
+		}
+		if changed != (tc.text != tc.want) {
+			t.Errorf("replaceTag(%q, %q, %q) reported changed=%v", tc.text, tc.from, tc.to, changed)
+		}
+		if !changed {
+			continue
+		}
+		for _, tag := range noteTags(got) {
+			if tag == tc.from {
+				t.Errorf("replaceTag(%q, %q, %q) result still has the old tag", tc.text, tc.from, tc.to)
+			}
+		}
+	}
+}
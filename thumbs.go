@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/artyom/notes-server/internal/imagemeta"
+)
+
+// thumbnailWidths are widths of downscaled copies made for uploaded images,
+// only the ones smaller than the image itself are made
+var thumbnailWidths = [...]int{320, 640, 1280}
+
+// thumbnail is a downscaled copy of an uploaded image
+type thumbnail struct {
+	width, height int
+	data          []byte
+}
+
+// thumbnailPath returns path of the thumbnail derived from the uploaded file
+// path .files/{hash}/{name}, which is .files/{hash}/{width}w/{name}
+func thumbnailPath(fPath string, width int) string {
+	dir, name := path.Split(fPath)
+	return path.Join(dir, fmt.Sprintf("%dw", width), name)
+}
+
+// makeThumbnails decodes image of the given format and returns its
+// thumbnails, skipping the ones that aren't smaller than the original size.
+// Thumbnails have no metadata, so the EXIF orientation of the image, if any,
+// is applied to them. Only JPEG and PNG images are supported, GIFs are left as
+// is so that animations are preserved. Images with more than
+// imagemeta.MaxPixels pixels get no thumbnails, as decoding them takes too much
+// memory.
+func makeThumbnails(r io.ReadSeeker, format string, size int64, orientation int) ([]thumbnail, error) {
+	if format != "jpeg" && format != "png" {
+		return nil, nil
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > imagemeta.MaxPixels {
+		return nil, nil
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	img = imagemeta.Orient(img, orientation)
+	var out []thumbnail
+	var src *image.RGBA
+	for _, w := range thumbnailWidths {
+		if w >= img.Bounds().Dx() {
+			break
+		}
+		if src == nil {
+			src = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+			draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+		}
+		buf := new(bytes.Buffer)
+		dst := downscale(src, w)
+		if format == "jpeg" {
+			err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if int64(buf.Len()) >= size {
+			continue
+		}
+		out = append(out, thumbnail{width: w, height: dst.Bounds().Dy(), data: buf.Bytes()})
+	}
+	return out, nil
+}
+
+// downscale returns src resized to the given width, keeping its aspect ratio.
+// Each destination pixel is an average of the source pixels it covers.
+func downscale(src *image.RGBA, width int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	height := (sh*width + sw/2) / sw
+	if height == 0 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride+x0*4 : sy*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += uint64(row[i])
+					sum[1] += uint64(row[i+1])
+					sum[2] += uint64(row[i+2])
+					sum[3] += uint64(row[i+3])
+				}
+			}
+			n := uint64((x1 - x0) * (y1 - y0))
+			i := y*dst.Stride + x*4
+			for c := range sum {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
+
+// imageMarkup returns <img> tag for the uploaded image at fPath with its
+// thumbnails listed in srcset
+func imageMarkup(fPath string, width, height int, thumbs []thumbnail) string {
+	link := fileURL(fPath)
+	if len(thumbs) == 0 {
+		return fmt.Sprintf("<img width=%d height=%d src=%q loading=lazy>", width, height, link)
+	}
+	var srcset []string
+	for _, t := range thumbs {
+		srcset = append(srcset, fmt.Sprintf("%s %dw", fileURL(thumbnailPath(fPath, t.width)), t.width))
+	}
+	srcset = append(srcset, fmt.Sprintf("%s %dw", link, width))
+	// sizes match the max-width of the page body in style.css
+	return fmt.Sprintf("<img width=%d height=%d src=%q srcset=%q sizes=%q loading=lazy>",
+		width, height, link, strings.Join(srcset, ", "), "(max-width: 45em) 100vw, 45em")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func Test_downscale(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 2; y++ {
+			if x < 2 {
+				src.Set(x, y, color.RGBA{R: 200, A: 255})
+			} else {
+				src.Set(x, y, color.RGBA{B: uint8(100 * y), A: 255})
+			}
+		}
+	}
+	dst := downscale(src, 2)
+	if got := dst.Bounds(); got != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("got bounds %v", got)
+	}
+	for x, want := range []color.RGBA{{R: 200, A: 255}, {B: 50, A: 255}} {
+		if got := dst.RGBAAt(x, 0); got != want {
+			t.Errorf("pixel %d: got %v, want %v", x, got, want)
+		}
+	}
+}
+
+func Test_thumbnailPath(t *testing.T) {
+	got := thumbnailPath(".files/Xk8cq26JlM7wz2FLz9my7vXhi4U/photo.jpg", 640)
+	if want := ".files/Xk8cq26JlM7wz2FLz9my7vXhi4U/640w/photo.jpg"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func Test_makeThumbnailsTooLarge(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// image/jpeg writes dimensions to the SOF0 segment as height and width
+	sof := bytes.Index(data, []byte{0xff, 0xc0})
+	binary.BigEndian.PutUint16(data[sof+5:], 10000)
+	binary.BigEndian.PutUint16(data[sof+7:], 10000)
+	thumbs, err := makeThumbnails(bytes.NewReader(data), "jpeg", int64(len(data)), 0)
+	if err != nil || len(thumbs) != 0 {
+		t.Fatalf("got %d thumbnails, error %v", len(thumbs), err)
+	}
+}
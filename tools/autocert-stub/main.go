@@ -53,7 +53,7 @@ func run(ctx context.Context, args runArgs) error {
 	} else if !st.Mode().IsRegular() {
 		return errors.New("database must be a regular file")
 	}
-	db, err := sql.Open("sqlite", args.database)
+	db, err := sql.Open("sqlite", args.database+"?_pragma=foreign_keys(1)")
 	if err != nil {
 		return err
 	}
@@ -68,7 +68,7 @@ func run(ctx context.Context, args runArgs) error {
 		return err
 	}
 	defer os.RemoveAll(tmpDir)
-	db, err := sql.Open("sqlite", args.DB)
+	db, err := sql.Open("sqlite", args.DB+"?_pragma=foreign_keys(1)")
 	if err != nil {
 		return err
 	}
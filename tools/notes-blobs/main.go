@@ -0,0 +1,111 @@
+// Program notes-blobs moves uploaded files of the notes database from one blob
+// storage to another. Run it with the notes-server stopped, then start the
+// server with the -blobs flag set to the new storage.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	log.SetFlags(0)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	args := runArgs{From: "sqlite"}
+	flag.StringVar(&args.DB, "db", args.DB, "`path` to notes database file")
+	flag.StringVar(&args.From, "from", args.From, "source `storage`, as in the notes-server -blobs flag")
+	flag.StringVar(&args.To, "to", args.To, "destination `storage`, as in the notes-server -blobs flag")
+	flag.BoolVar(&args.Keep, "keep", args.Keep, "keep blobs in the source storage once copied")
+	flag.Parse()
+	if err := run(ctx, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type runArgs struct {
+	DB, From, To string
+	Keep         bool
+}
+
+func run(ctx context.Context, args runArgs) error {
+	if args.DB == "" {
+		return errors.New("no database provided")
+	}
+	if args.To == "" {
+		return errors.New("no destination storage provided")
+	}
+	if args.From == args.To {
+		return errors.New("source and destination storages are the same")
+	}
+	if _, err := os.Stat(args.DB); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", args.DB+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	src, err := blobstore.Open(ctx, args.From, db)
+	if err != nil {
+		return fmt.Errorf("opening source storage: %w", err)
+	}
+	dst, err := blobstore.Open(ctx, args.To, db)
+	if err != nil {
+		return fmt.Errorf("opening destination storage: %w", err)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT Hash, Size FROM files UNION SELECT Hash, Size FROM trash_files`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var hash string
+		var size int64
+		if err := rows.Scan(&hash, &size); err != nil {
+			return err
+		}
+		sizes[hash] = size
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var moved, skipped int
+	for hash, size := range sizes {
+		switch err := blobstore.Copy(ctx, dst, src, hash, size); {
+		case err == nil:
+		case errors.Is(err, fs.ErrNotExist):
+			// may be already moved by an earlier interrupted run
+			r, err := dst.Get(ctx, hash)
+			if err != nil {
+				log.Printf("blob %q: %v", hash, err)
+				continue
+			}
+			r.Close()
+			skipped++
+			continue
+		default:
+			return fmt.Errorf("copying %q: %w", hash, err)
+		}
+		moved++
+		if args.Keep {
+			continue
+		}
+		if err := src.Delete(ctx, hash); err != nil {
+			return fmt.Errorf("deleting %q from the source storage: %w", hash, err)
+		}
+	}
+	log.Printf("moved %d blobs, %d were already in the destination storage", moved, skipped)
+	return nil
+}
@@ -25,6 +25,7 @@ import (
 	"unicode"
 	"unicode/utf8"
 
+	"github.com/artyom/notes-server/internal/blobstore"
 	"github.com/artyom/notes-server/internal/markdown"
 	gtext "github.com/yuin/goldmark/text"
 	"golang.org/x/net/html"
@@ -35,10 +36,11 @@ import (
 
 func main() {
 	log.SetFlags(0)
-	args := runArgs{Tag: "public"}
+	args := runArgs{Tag: "public", Blobs: "sqlite"}
 	flag.StringVar(&args.DB, "db", args.DB, "`path` to notes database file")
 	flag.StringVar(&args.Dir, "dir", args.Dir, "destination `directory` to export notes into")
 	flag.StringVar(&args.Tag, "tag", args.Tag, "export notes which have this `tag` assigned")
+	flag.StringVar(&args.Blobs, "blobs", args.Blobs, "`storage` of uploaded files, as in the notes-server -blobs flag")
 	flag.StringVar(&args.IndexTemplate, "index", args.IndexTemplate,
 		"`path` to the auto-generated index page template file; no value enables built-in template")
 	flag.StringVar(&args.PageTemplate, "page", args.PageTemplate,
@@ -55,6 +57,7 @@ type runArgs struct {
 	Dir           string
 	IndexTemplate string
 	PageTemplate  string
+	Blobs         string
 }
 
 func (a *runArgs) validate() error {
@@ -92,12 +95,17 @@ func run(args runArgs) error {
 	if _, err := os.Stat(args.DB); err != nil {
 		return err
 	}
-	db, err := sql.Open("sqlite", args.DB)
+	db, err := sql.Open("sqlite", args.DB+"?_pragma=foreign_keys(1)")
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	ctx := context.Background()
+	blobs, err := blobstore.OpenReadOnly(ctx, args.Blobs, db)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
 		return err
 	}
@@ -105,16 +113,20 @@ func run(args runArgs) error {
 	if err := savePages(tx, args, pageTemplate, indexTemplate); err != nil {
 		return err
 	}
-	return saveAttachments(tx, args)
+	return saveAttachments(ctx, tx, blobs, args)
 }
 
-func saveAttachments(tx *sql.Tx, args runArgs) error {
+func saveAttachments(ctx context.Context, tx *sql.Tx, blobs blobstore.Store, args runArgs) error {
 	rows, err := tx.Query(`WITH exp AS (
 		SELECT DISTINCT notes.Path FROM notes, json_each(notes.Tags)
 		WHERE json_each.value=?
 	)
-	SELECT files.Path,Bytes,Ctime FROM files, exp
-	WHERE files.NotePath=exp.Path`, args.Tag)
+	, att AS (
+		SELECT note_files.Path FROM note_files, exp
+		WHERE note_files.NotePath=exp.Path
+	)
+	SELECT Path,Hash,Ctime FROM files
+	WHERE Path IN (SELECT Path FROM att) OR Original IN (SELECT Path FROM att)`, args.Tag)
 	if err != nil {
 		return err
 	}
@@ -122,11 +134,10 @@ func saveAttachments(tx *sql.Tx, args runArgs) error {
 	defer rows.Close()
 	for rows.Next() {
 		var att struct {
-			path  string
-			ctime int64
-			data  []byte
+			path, hash string
+			ctime      int64
 		}
-		if err := rows.Scan(&att.path, &att.data, &att.ctime); err != nil {
+		if err := rows.Scan(&att.path, &att.hash, &att.ctime); err != nil {
 			return err
 		}
 		if !fs.ValidPath(att.path) {
@@ -139,8 +150,8 @@ func saveAttachments(tx *sql.Tx, args runArgs) error {
 		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
 			return err
 		}
-		if err := os.WriteFile(dst, att.data, 0666); err != nil {
-			return err
+		if err := saveBlob(ctx, blobs, att.hash, dst); err != nil {
+			return fmt.Errorf("saving %q: %w", att.path, err)
 		}
 		mtime := time.Unix(att.ctime, 0).UTC()
 		if err := os.Chtimes(dst, mtime, mtime); err != nil {
@@ -158,6 +169,23 @@ func saveAttachments(tx *sql.Tx, args runArgs) error {
 	return os.WriteFile(filepath.Join(args.Dir, leftmostPrefix, "index.html"), []byte(":-P"), 0666)
 }
 
+func saveBlob(ctx context.Context, blobs blobstore.Store, key, dst string) error {
+	r, err := blobs.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func savePages(tx *sql.Tx, args runArgs, pageTemplate, indexTemplate *template.Template) error {
 	buf := new(bytes.Buffer)
 	if err := indexTemplate.Execute(buf, nil); err != nil {
@@ -201,6 +229,7 @@ func savePages(tx *sql.Tx, args runArgs, pageTemplate, indexTemplate *template.T
 		}
 		note.Ctime = time.Unix(note.ctime, 0).UTC()
 		note.Mtime = time.Unix(note.mtime, 0).UTC()
+		_, bodyBytes := markdown.FrontMatter(bodyBytes)
 		doc := markdown.Markdown.Parser().Parse(gtext.NewReader(bodyBytes))
 		if note.TOC, err = markdown.AssignHeaderIDs(bodyBytes, doc); err != nil {
 			return fmt.Errorf("path: %s, title: %s, assigning header ids: %w", note.Path, note.Title, err)
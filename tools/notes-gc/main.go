@@ -0,0 +1,89 @@
+// Program notes-gc removes uploaded files that notes of the notes database no
+// longer link to, along with their content in the blob storage.
+//
+// Unreferenced files are removed only after they stay unreferenced for longer
+// than the grace period: the first run marks them, and a later run removes
+// them. Use -grace=0 to remove them right away.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+	"github.com/artyom/notes-server/internal/filegc"
+	_ "modernc.org/sqlite"
+)
+
+func main() {
+	log.SetFlags(0)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	args := runArgs{Blobs: "sqlite", Grace: 7 * 24 * time.Hour}
+	flag.StringVar(&args.DB, "db", args.DB, "`path` to notes database file")
+	flag.StringVar(&args.Blobs, "blobs", args.Blobs, "blob `storage`, as in the notes-server -blobs flag")
+	flag.DurationVar(&args.Grace, "grace", args.Grace, "remove files that are unreferenced for longer than this `period`")
+	flag.BoolVar(&args.DryRun, "n", args.DryRun, "dry run: only report files that would be removed")
+	flag.Parse()
+	if err := run(ctx, args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type runArgs struct {
+	DB, Blobs string
+	Grace     time.Duration
+	DryRun    bool
+}
+
+func run(ctx context.Context, args runArgs) error {
+	if args.DB == "" {
+		return errors.New("no database provided")
+	}
+	if _, err := os.Stat(args.DB); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite", args.DB+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1) // so that busy_timeout applies to all queries
+	if _, err := db.ExecContext(ctx, `PRAGMA busy_timeout=5000`); err != nil {
+		return err
+	}
+	blobs, err := blobstore.Open(ctx, args.Blobs, db)
+	if err != nil {
+		return fmt.Errorf("opening blob storage: %w", err)
+	}
+	report, err := filegc.Run(ctx, db, blobs, filegc.Options{Grace: args.Grace, DryRun: args.DryRun})
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, f := range report.Files {
+		status := "unused since " + f.Orphaned.Format(time.DateTime)
+		if f.Removed {
+			removed++
+			status = "removed"
+			if args.DryRun {
+				status = "to be removed"
+			}
+		}
+		fmt.Printf("%s\t%s\t%d\t%s\n", f.Path, strings.Join(f.Notes, ","), f.Size, status)
+	}
+	verb := "removed"
+	if args.DryRun {
+		verb = "to be removed"
+	}
+	log.Printf("%d unreferenced files, %d %s, %d blobs %s", len(report.Files), removed, verb, report.Blobs, verb)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// deleteNote moves note at path p along with its attachments to the trash. It
+// returns sql.ErrNoRows if there's no such note.
+func (h *handler) deleteNote(ctx context.Context, p string) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `INSERT INTO trash(Path,Title,Text,Ctime,Mtime,Tags,Meta)
+		SELECT Path,Title,Text,Ctime,Mtime,Tags,Meta FROM notes WHERE Path=@path`, sql.Named("path", p))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	// files shared with other notes stay in place as well, deleting the
+	// note only removes the ones it was the last to use
+	if _, err := tx.ExecContext(ctx, `INSERT INTO trash_files(Path,Hash,Size,Ctime,Original,SourceHash,Type,Name,Width,Height,TrashID)
+		SELECT Path,Hash,Size,Ctime,Original,SourceHash,Type,Name,Width,Height,@id FROM files
+		WHERE Path IN (SELECT Path FROM note_files WHERE NotePath=@path)
+		OR Original IN (SELECT Path FROM note_files WHERE NotePath=@path)`, sql.Named("path", p), sql.Named("id", id)); err != nil {
+		return err
+	}
+	if _, err := tx.StmtContext(ctx, h.stDeletePage).ExecContext(ctx, sql.Named("path", p)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restoreNote moves note with its attachments back from the trash and returns
+// its path. It returns errNoteExists if the original path is taken by another
+// note, and sql.ErrNoRows if there's no such note in the trash.
+func (h *handler) restoreNote(ctx context.Context, id int64) (string, error) {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var p, text string
+	if err := tx.QueryRowContext(ctx, `SELECT Path, Text FROM trash WHERE ID=@id`, sql.Named("id", id)).Scan(&p, &text); err != nil {
+		return "", err
+	}
+	switch err := tx.StmtContext(ctx, h.stEditPage).QueryRowContext(ctx, sql.Named("path", p)).Scan(new(string)); err {
+	case nil:
+		return "", errNoteExists
+	case sql.ErrNoRows:
+	default:
+		return "", err
+	}
+	for _, s := range [...]string{
+		`INSERT INTO notes(Path,Title,Text,Ctime,Mtime,Tags,Meta)
+			SELECT Path,Title,Text,Ctime,Mtime,Tags,Meta FROM trash WHERE ID=@id`,
+		`INSERT OR IGNORE INTO files(Path,Hash,Size,Ctime,Original,SourceHash,Type,Name,Width,Height)
+			SELECT Path,Hash,Size,Ctime,Original,SourceHash,Type,Name,Width,Height FROM trash_files WHERE TrashID=@id`,
+		`INSERT OR IGNORE INTO note_files(NotePath,Path)
+			SELECT @path,Path FROM trash_files WHERE TrashID=@id AND Original IS NULL`,
+		`DELETE FROM trash WHERE ID=@id`,
+		`DELETE FROM redirects WHERE Path=@path`,
+	} {
+		if _, err := tx.ExecContext(ctx, s, sql.Named("id", id), sql.Named("path", p)); err != nil {
+			return "", err
+		}
+	}
+	if err := h.updateLinks(ctx, tx, p, text); err != nil {
+		return "", err
+	}
+	return p, tx.Commit()
+}
+
+// purgeTrash permanently removes notes deleted before the given time, or a
+// single note if id is not zero, along with history of notes that no longer
+// exist.
+func (h *handler) purgeTrash(ctx context.Context, before time.Time, id int64) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, s := range [...]string{
+		`DELETE FROM trash WHERE Dtime<@before OR ID=@id`,
+		`DELETE FROM notes_history WHERE Path NOT IN (SELECT Path FROM notes) AND Path NOT IN (SELECT Path FROM trash)`,
+	} {
+		if _, err := tx.ExecContext(ctx, s, sql.Named("before", before.Unix()), sql.Named("id", id)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purgeTrashLoop periodically purges notes that were in the trash for longer
+// than the retention period
+func (h *handler) purgeTrashLoop(ctx context.Context, retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := h.purgeTrash(ctx, time.Now().Add(-retention), 0); err != nil && ctx.Err() == nil {
+			log.Printf("purging trash: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// trashEntry describes a deleted note
+type trashEntry struct {
+	ID          int64
+	Path, Title string
+	Dtime       time.Time
+	Files       int
+}
+
+func (h *handler) trashPage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		h.trashAction(w, r)
+		return
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := h.db.QueryContext(r.Context(), `SELECT ID, Path, Title, Dtime,
+		(SELECT count(*) FROM trash_files WHERE TrashID=trash.ID AND Original IS NULL)
+		FROM trash ORDER BY Dtime DESC, ID DESC`)
+	if err != nil {
+		log.Printf("trash: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	var entries []trashEntry
+	for rows.Next() {
+		var ent trashEntry
+		var dtime int64
+		if err := rows.Scan(&ent.ID, &ent.Path, &ent.Title, &dtime, &ent.Files); err != nil {
+			log.Printf("trash: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		ent.Dtime = time.Unix(dtime, 0)
+		entries = append(entries, ent)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("trash: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	trashTemplate.Execute(w, struct {
+		Entries   []trashEntry
+		Retention string
+	}{
+		Entries:   entries,
+		Retention: retentionText(h.trashRetention),
+	})
+}
+
+// retentionText returns human-readable representation of the trash retention
+// period
+func retentionText(d time.Duration) string {
+	const day = 24 * time.Hour
+	switch {
+	case d <= 0:
+		return ""
+	case d == day:
+		return "1 day"
+	case d%day == 0:
+		return strconv.Itoa(int(d/day)) + " days"
+	}
+	return d.String()
+}
+
+func (h *handler) trashAction(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("empty") == "true" {
+		if err := h.purgeTrash(r.Context(), time.Now().Add(time.Second), 0); err != nil {
+			log.Printf("emptying trash: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	if s := r.PostForm.Get("purge"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := h.purgeTrash(r.Context(), time.Time{}, id); err != nil {
+			log.Printf("purging %d from trash: %v", id, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	id, err := strconv.ParseInt(r.PostForm.Get("restore"), 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	p, err := h.restoreNote(r.Context(), id)
+	switch err {
+	case nil:
+		http.Redirect(w, r, (&url.URL{Path: "/" + p}).String(), http.StatusSeeOther)
+	case sql.ErrNoRows:
+		http.Error(w, "No such note in the trash", http.StatusNotFound)
+	case errNoteExists:
+		http.Error(w, "There is already a note at this path, move it elsewhere first", http.StatusConflict)
+	default:
+		log.Printf("restoring %d from trash: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_deleteMovedNote(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('a', 'A', '# A')`); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.renderPage(w, httptest.NewRequest(http.MethodGet, p, nil))
+		return w
+	}
+	if err := h.moveNote(ctx, "a", "b", false); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/a"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/b" {
+		t.Fatalf("moved note: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	if err := h.deleteNote(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/a"); w.Code != http.StatusNotFound {
+		t.Fatalf("old path of deleted note: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+	var id int64
+	if err := db.QueryRowContext(ctx, `SELECT ID FROM trash WHERE Path='b'`).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.restoreNote(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if w := get("/a"); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/b" {
+		t.Fatalf("old path of restored note: got %d to %q", w.Code, w.Header().Get("Location"))
+	}
+}
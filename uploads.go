@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
@@ -15,11 +17,19 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+	"github.com/artyom/notes-server/internal/imagemeta"
+	"github.com/artyom/notes-server/internal/plaintext"
 )
 
 func (h *handler) uploadFile(w http.ResponseWriter, r *http.Request) {
@@ -28,150 +38,802 @@ func (h *handler) uploadFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
 	}
-	var notePath string
-	if docURL, err := url.Parse(r.FormValue("document")); err != nil ||
-		docURL.Path == "" || docURL.Path == "/" || docURL.Path == "." || !fs.ValidPath(docURL.Path[1:]) {
+	form, up, ok := h.readUploadForm(w, r, "file")
+	if !ok {
+		return
+	}
+	defer up.tf.Remove()
+	notePath, ok := uploadNotePath(form.Get("document"))
+	if !ok {
 		http.Error(w, "Invalid 'document' form field", http.StatusBadRequest)
 		return
-	} else {
-		notePath = docURL.Path[1:]
 	}
-	const sizeLimit = 10 << 20
-	r.Body = http.MaxBytesReader(w, r.Body, sizeLimit)
-	f, hdr, err := r.FormFile("file")
+	_, link, err := h.storeUpload(r.Context(), notePath, up)
 	if err != nil {
-		log.Printf("FormFile: %v", err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		h.uploadFailed(w, err)
 		return
 	}
-	defer f.Close()
-	if r.MultipartForm != nil {
-		defer r.MultipartForm.RemoveAll()
-	}
-	if hdr.Size <= 0 || hdr.Size > sizeLimit {
-		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
-		return
+	writeUploadLink(w, link)
+}
+
+// readUploadForm reads multipart form with a single file in the fileField,
+// streaming it to a temporary file up.tf, which the caller must remove. Values of
+// other form fields are returned in form. If the form is invalid or the file
+// is missing, readUploadForm replies to the client and returns false.
+func (h *handler) readUploadForm(w http.ResponseWriter, r *http.Request, fileField string) (form url.Values,
+	up fileUpload, ok bool) {
+	// leave some room for the form fields other than the file itself
+	const formOverhead = 64 << 10
+	if r.ContentLength > h.maxFileSize+formOverhead {
+		http.Error(w, errFileTooLarge{h.maxFileSize}.Error(), http.StatusRequestEntityTooLarge)
+		return nil, fileUpload{}, false
 	}
-	filename, err := validateFilename(hdr.Filename)
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxFileSize+formOverhead)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Bad file name", http.StatusBadRequest)
-		return
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, fileUpload{}, false
 	}
-	buf := make([]byte, hdr.Size)
-	if _, err := io.ReadFull(f, buf); err != nil {
-		log.Printf("file upload ReadFull: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+	defer func() {
+		if !ok && up.tf != nil {
+			up.tf.Remove()
+		}
+	}()
+	form = make(url.Values)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if maxErr := (*http.MaxBytesError)(nil); !errors.As(err, &maxErr) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return nil, fileUpload{}, false
+			}
+			h.uploadFailed(w, err)
+			return nil, fileUpload{}, false
+		}
+		switch name := part.FormName(); {
+		case name == fileField && part.FileName() != "":
+			if up.tf != nil {
+				http.Error(w, "Only one file per upload is supported", http.StatusBadRequest)
+				return nil, fileUpload{}, false
+			}
+			if up.name, err = validateFilename(part.FileName()); err != nil {
+				http.Error(w, "Bad file name", http.StatusBadRequest)
+				return nil, fileUpload{}, false
+			}
+			up.contentType = part.Header.Get("Content-Type")
+			if up.tf, err = spoolUpload(part, h.maxFileSize); err != nil {
+				h.uploadFailed(w, err)
+				return nil, fileUpload{}, false
+			}
+		case name != "":
+			b, err := io.ReadAll(io.LimitReader(part, 4<<10))
+			if err != nil {
+				h.uploadFailed(w, err)
+				return nil, fileUpload{}, false
+			}
+			form.Add(name, string(b))
+		}
+		part.Close()
+	}
+	if up.tf == nil || up.tf.size == 0 {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return nil, fileUpload{}, false
+	}
+	return form, up, true
+}
+
+// fileURL returns link to the uploaded file at fPath
+func fileURL(fPath string) string { return (&url.URL{Path: "/" + fPath}).String() }
+
+// uploadNotePath returns path of the note from the document URL sent along
+// with the upload
+func uploadNotePath(docURL string) (string, bool) {
+	u, err := url.Parse(docURL)
+	if err != nil || u.Path == "" || u.Path == "/" || u.Path == "." || !fs.ValidPath(u.Path[1:]) {
+		return "", false
+	}
+	return u.Path[1:], true
+}
+
+// fileUpload is a file received from the client
+type fileUpload struct {
+	name        string // validated file name
+	contentType string // media type declared by the client, if any
+	tf          *tempFile
+}
+
+// storeUpload stores uploaded file as an attachment of the note and returns
+// its path and a link to it, which is an <img> tag for images. It returns
+// errNoteQuota if the note attachments would exceed the per-note limit.
+func (h *handler) storeUpload(ctx context.Context, notePath string, up fileUpload) (fPath, link string, err error) {
+	tf := up.tf
+	var sourceHash string
+	if !h.keepMetadata {
+		clean, err := cleanImage(tf)
+		if err != nil {
+			return "", "", err
+		}
+		if clean != nil {
+			defer clean.Remove()
+			sourceHash, tf = tf.hash(), clean
+		}
+	}
+	hash := tf.hash()
+	fPath = path.Join(".files", hash, up.name)
+	if err := h.checkNoteQuota(ctx, notePath, fPath, tf.size); err != nil {
+		return "", "", err
 	}
 	var imgAttrs struct {
 		valid         bool
 		width, height int
+		format        string
 	}
-	if strings.HasPrefix(http.DetectContentType(buf), "image/") {
-		cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	head := make([]byte, 512)
+	n, _ := tf.ReadAt(head, 0)
+	fileType := uploadType(up.name, up.contentType, head[:n])
+	if strings.HasPrefix(http.DetectContentType(head[:n]), "image/") {
+		cfg, format, err := image.DecodeConfig(io.NewSectionReader(tf, 0, tf.size))
 		imgAttrs.valid = err == nil
 		imgAttrs.width = cfg.Width
 		imgAttrs.height = cfg.Height
+		imgAttrs.format = format
+		if imgAttrs.valid {
+			fileType = "image/" + format
+		}
+	}
+	// metadata is only kept if asked to, then browsers apply orientation
+	// to the original, while its thumbnails are rotated when made
+	var orientation int
+	if imgAttrs.valid && h.keepMetadata {
+		head := make([]byte, 256<<10)
+		n, _ := tf.ReadAt(head, 0)
+		if orientation = imagemeta.Orientation(head[:n]); orientation >= 5 {
+			imgAttrs.width, imgAttrs.height = imgAttrs.height, imgAttrs.width
+		}
 	}
-	sum := sha1.Sum(buf)
-	fPath := path.Join(".files", base64.RawURLEncoding.EncodeToString(sum[:]), filename)
-	_, err = h.stUploadFile.ExecContext(r.Context(),
-		sql.Named("path", fPath),
-		sql.Named("bytes", buf),
-		sql.Named("notepath", notePath),
-	)
+	if err := h.putFile(ctx, io.NewSectionReader(tf, 0, tf.size), fileRecord{Path: fPath, Hash: hash,
+		Size: tf.size, NotePath: notePath, SourceHash: sourceHash, Type: fileType, Name: up.name,
+		Width: imgAttrs.width, Height: imgAttrs.height}); err != nil {
+		return "", "", err
+	}
+	if plaintext.Indexable(fileType) {
+		if err := indexFileText(ctx, h.db, hash, fileType, io.NewSectionReader(tf, 0, tf.size)); err != nil {
+			log.Printf("indexing %q text: %v", fPath, err)
+		}
+	}
+	if !imgAttrs.valid {
+		return fPath, fileURL(fPath), nil
+	}
+	thumbs, err := makeThumbnails(io.NewSectionReader(tf, 0, tf.size), imgAttrs.format, tf.size, orientation)
 	if err != nil {
-		log.Printf("storing file: %v", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		log.Printf("making %q thumbnails: %v", fPath, err)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	u := &url.URL{Path: "/" + fPath}
-	link := u.String()
-	if imgAttrs.valid {
-		link = fmt.Sprintf("<img width=%d height=%d src=%q loading=lazy>", imgAttrs.width, imgAttrs.height, link)
+	for _, t := range thumbs {
+		sum := sha1.Sum(t.data)
+		tHash := base64.RawURLEncoding.EncodeToString(sum[:])
+		if err := h.putFile(ctx, bytes.NewReader(t.data), fileRecord{Path: thumbnailPath(fPath, t.width), Hash: tHash,
+			Size: int64(len(t.data)), Original: fPath, Type: fileType, Name: up.name,
+			Width: t.width, Height: t.height}); err != nil {
+			return "", "", err
+		}
+	}
+	return fPath, imageMarkup(fPath, imgAttrs.width, imgAttrs.height, thumbs), nil
+}
+
+// fileRecord describes a row of the files table
+type fileRecord struct {
+	Path, Hash string
+	NotePath   string // note the file is uploaded to, empty for thumbnails
+	Size       int64
+	Original   string // for thumbnails, path of the uploaded image
+	SourceHash string // hash of the uploaded file if its metadata was removed
+	Type       string // media type
+	Name       string // file name as uploaded
+	Width      int    // image dimensions, zero for other files
+	Height     int
+}
+
+// uploadType returns media type of the uploaded file: the one declared by the
+// client unless it is missing or generic, otherwise the one known for the file
+// name extension, or the one detected from the head of the file content
+func uploadType(name, declared string, head []byte) string {
+	if t, params, err := mime.ParseMediaType(declared); err == nil && t != "application/octet-stream" {
+		if s := mime.FormatMediaType(t, params); s != "" {
+			return s
+		}
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return http.DetectContentType(head)
+}
+
+// putFile stores the file content read from r in the blob storage and records
+// the file with addFile. The content is stored again if the blob was removed
+// by the garbage collection in between.
+func (h *handler) putFile(ctx context.Context, r io.ReadSeeker, f fileRecord) error {
+	for attempt := 0; ; attempt++ {
+		if err := h.blobs.Put(ctx, f.Hash, r, f.Size); err != nil {
+			return fmt.Errorf("storing blob: %w", err)
+		}
+		err := h.addFile(ctx, f)
+		if !errors.Is(err, errBlobRemoved) || attempt == 2 {
+			return err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+}
+
+// errBlobRemoved is returned by addFile if the blob of the file is not in the
+// storage
+var errBlobRemoved = errors.New("blob was removed from the storage")
+
+// addFile records file stored in the blob storage as an attachment of the
+// note. If the same file was already uploaded to another note, it is shared
+// by both notes. It returns errBlobRemoved if the blob of the file is missing,
+// as the garbage collection may remove it after it was stored.
+func (h *handler) addFile(ctx context.Context, f fileRecord) error {
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.StmtContext(ctx, h.stUploadFile).ExecContext(ctx,
+		sql.Named("path", f.Path),
+		sql.Named("hash", f.Hash),
+		sql.Named("size", f.Size),
+		sql.Named("original", nullString(f.Original)),
+		sql.Named("sourcehash", nullString(f.SourceHash)),
+		sql.Named("type", nullString(f.Type)),
+		sql.Named("name", nullString(f.Name)),
+		sql.Named("width", nullInt(f.Width)),
+		sql.Named("height", nullInt(f.Height)),
+	); err != nil {
+		return err
+	}
+	// the insert took the write lock, which the garbage collection holds
+	// while removing blobs, so the blob can't be removed after this check
+	// until the file is recorded
+	switch b, err := h.blobs.Get(ctx, f.Hash); {
+	case errors.Is(err, fs.ErrNotExist):
+		return errBlobRemoved
+	case err != nil:
+		return err
+	default:
+		b.Close()
+	}
+	if f.NotePath != "" {
+		if _, err := tx.StmtContext(ctx, h.stAttachFile).ExecContext(ctx,
+			sql.Named("notepath", f.NotePath),
+			sql.Named("path", f.Path),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullString returns nil for an empty string, so it's stored as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullInt returns nil for zero, so it's stored as NULL
+func nullInt(n int) any {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
+
+// cleanImage returns a copy of the JPEG or PNG image in tf without EXIF and
+// other metadata, and with orientation applied. It returns nil if tf is not
+// such an image, or if it has nothing to remove. Images that can't be cleaned
+// are refused with errBadImage.
+func cleanImage(tf *tempFile) (*tempFile, error) {
+	head := make([]byte, 512)
+	n, _ := tf.ReadAt(head, 0)
+	if ct := http.DetectContentType(head[:n]); ct != "image/jpeg" && ct != "image/png" {
+		return nil, nil
+	}
+	clean, err := newTempFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := imagemeta.Clean(clean, io.NewSectionReader(tf, 0, tf.size)); err != nil {
+		clean.Remove()
+		if errors.Is(err, imagemeta.ErrFormat) || errors.Is(err, imagemeta.ErrTooLarge) {
+			return nil, errBadImage{err}
+		}
+		return nil, err
 	}
+	if clean.hash() == tf.hash() {
+		clean.Remove()
+		return nil, nil
+	}
+	return clean, nil
+}
+
+// checkNoteQuota returns errNoteQuota if adding size bytes to attachments of
+// the note would exceed the per-note limit. File at fPath is not counted, as
+// uploading the same file again doesn't take any space.
+func (h *handler) checkNoteQuota(ctx context.Context, notePath, fPath string, size int64) error {
+	if h.maxNoteSize <= 0 {
+		return nil
+	}
+	var used int64
+	if err := h.stNoteFilesSize.QueryRowContext(ctx, sql.Named("notepath", notePath), sql.Named("path", fPath)).
+		Scan(&used); err != nil {
+		return fmt.Errorf("getting note %q attachments size: %w", notePath, err)
+	}
+	if used+size > h.maxNoteSize {
+		return errNoteQuota{h.maxNoteSize}
+	}
+	return nil
+}
+
+func writeUploadLink(w http.ResponseWriter, link string) {
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct{ URL string }{URL: link})
 }
 
+// uploadFailed replies with 413 if err is about size limits, or logs err
+// and replies with a generic error otherwise
+func (h *handler) uploadFailed(w http.ResponseWriter, err error) {
+	var fileErr errFileTooLarge
+	var noteErr errNoteQuota
+	var imageErr errBadImage
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &fileErr), errors.As(err, &noteErr):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &imageErr):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.As(err, &maxErr):
+		http.Error(w, errFileTooLarge{h.maxFileSize}.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("file upload: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// errNoteQuota is returned when note attachments would exceed the per-note
+// size limit
+type errNoteQuota struct{ limit int64 }
+
+func (e errNoteQuota) Error() string {
+	return fmt.Sprintf("Note attachments would exceed the %v limit", byteSize(e.limit))
+}
+
+// errBadImage is returned for uploaded images which metadata can't be removed
+// from
+type errBadImage struct{ err error }
+
+func (e errBadImage) Error() string {
+	return fmt.Sprintf("Cannot remove metadata from the image: %v", e.err)
+}
+
+func (e errBadImage) Unwrap() error { return e.err }
+
+// errFileTooLarge is returned when uploaded file exceeds the size limit
+type errFileTooLarge struct{ limit int64 }
+
+func (e errFileTooLarge) Error() string {
+	return fmt.Sprintf("File is larger than the %v limit", byteSize(e.limit))
+}
+
+// tempFile is a temporary file holding uploaded content, with its sha1
+// computed while it was written
+type tempFile struct {
+	f    *os.File
+	size int64
+	sum  hash.Hash
+}
+
+func newTempFile() (*tempFile, error) {
+	f, err := os.CreateTemp("", "notes-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &tempFile{f: f, sum: sha1.New()}, nil
+}
+
+func (tf *tempFile) Write(b []byte) (int, error) {
+	n, err := tf.f.Write(b)
+	tf.sum.Write(b[:n])
+	tf.size += int64(n)
+	return n, err
+}
+
+func (tf *tempFile) ReadAt(b []byte, off int64) (int, error) { return tf.f.ReadAt(b, off) }
+
+// hash returns the blob storage key of the file content
+func (tf *tempFile) hash() string { return base64.RawURLEncoding.EncodeToString(tf.sum.Sum(nil)) }
+
+// Remove closes and removes the file
+func (tf *tempFile) Remove() {
+	tf.f.Close()
+	os.Remove(tf.f.Name())
+}
+
+// spoolUpload copies r to a new temporary file, failing with errFileTooLarge
+// once more than limit bytes are read
+func spoolUpload(r io.Reader, limit int64) (*tempFile, error) {
+	tf, err := newTempFile()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tf, io.LimitReader(r, limit+1)); err != nil {
+		tf.Remove()
+		return nil, err
+	}
+	if tf.size > limit {
+		tf.Remove()
+		return nil, errFileTooLarge{limit}
+	}
+	return tf, nil
+}
+
+// byteSize is a flag.Value for sizes like "10MiB" or "1.5GB"
+type byteSize int64
+
+func (b byteSize) String() string {
+	for _, u := range byteUnits[:3] {
+		if int64(b) >= u.size {
+			return strings.TrimSuffix(strconv.FormatFloat(float64(b)/float64(u.size), 'f', 1, 64), ".0") + u.name
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+func (b *byteSize) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(v)
+	return nil
+}
+
+var byteUnits = [...]struct {
+	name string
+	size int64
+}{
+	{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	{"GB", 1e9}, {"MB", 1e6}, {"KB", 1e3},
+	{"B", 1},
+}
+
+func parseByteSize(s string) (int64, error) {
+	num, unit := strings.TrimSpace(s), int64(1)
+	for _, u := range byteUnits {
+		if v, ok := strings.CutSuffix(num, u.name); ok {
+			num, unit = strings.TrimSpace(v), u.size
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || f*float64(unit) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(unit)), nil
+}
+
+var errBadFilename = errors.New("invalid file name")
+
 func validateFilename(name string) (string, error) {
 	name = path.Base(name)
 	if name == "" || name == "." || strings.Contains(name, "/") || !fs.ValidPath(name) {
-		return "", errors.New("invalid file name")
+		return "", errBadFilename
 	}
 	return name, nil
 }
 
-// uploadFileInfo is a fs.FileInfo implementation for file uploads read access
-type uploadFileInfo struct {
-	name        string
-	size, ctime int64
+// uploadsHandler serves uploaded files. Their paths are derived from the
+// content, so responses can be cached forever.
+type uploadsHandler struct {
+	stmt  *sql.Stmt
+	blobs blobstore.Store
 }
 
-func (fi *uploadFileInfo) Name() string       { return fi.name }
-func (fi *uploadFileInfo) Size() int64        { return fi.size }
-func (fi *uploadFileInfo) Mode() fs.FileMode  { return 0444 }
-func (fi *uploadFileInfo) ModTime() time.Time { return time.Unix(fi.ctime, 0) }
-func (fi *uploadFileInfo) IsDir() bool        { return false }
-func (fi *uploadFileInfo) Sys() any           { return nil }
+func newUploadsHandler(db *sql.DB, blobs blobstore.Store) uploadsHandler {
+	return uploadsHandler{
+		stmt:  mustPrepare(db, `SELECT Ctime, Hash, coalesce(Type,'') FROM files WHERE Path=@path`),
+		blobs: blobs,
+	}
+}
 
-// uploadFile is a fs.File implementation for file uploads read access
-type uploadFile struct {
-	r  *bytes.Reader
-	fi uploadFileInfo
+func (u uploadsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", filesCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !fs.ValidPath(name) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	var ctime int64
+	var hash, fileType string
+	switch err := u.stmt.QueryRowContext(r.Context(), sql.Named("path", name)).Scan(&ctime, &hash, &fileType); err {
+	case nil:
+	case sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Printf("serving %q: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	f, err := u.blobs.Get(r.Context(), hash)
+	if err != nil {
+		log.Printf("reading %q blob: %v", name, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// hash is the sha1 of the file content, which makes a strong validator
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	// files uploaded before types were stored get the type from the file
+	// name, never from sniffing, which may find HTML in a text file
+	if fileType == "" {
+		fileType = mime.TypeByExtension(path.Ext(name))
+	}
+	if fileType == "" {
+		fileType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", fileType)
+	w.Header().Set("Content-Disposition", contentDisposition(fileType, path.Base(name)))
+	http.ServeContent(w, r, path.Base(name), time.Unix(ctime, 0), f)
 }
 
-func (f *uploadFile) Stat() (fs.FileInfo, error) { return &f.fi, nil }
+// filesRedirect redirects requests for uploaded files to the same paths on
+// the separate origin at base
+func filesRedirect(base *url.URL) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		u := *base
+		u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+		u.RawPath, u.RawQuery, u.Fragment = "", "", ""
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	})
+}
 
-func (f *uploadFile) Read(b []byte) (int, error) {
-	if f.r == nil {
-		return 0, fs.ErrClosed
+// filesCSP is the Content-Security-Policy of uploaded files. Files are served
+// from the same origin as notes, so a browser opening an uploaded HTML page
+// must not run its scripts, which could otherwise edit or delete notes.
+const filesCSP = "sandbox; default-src 'none'; img-src 'self' data:; media-src 'self'; style-src 'unsafe-inline'"
+
+// contentDisposition returns the Content-Disposition header value for a file
+// of the given media type: media files are shown inline, others, and active
+// content in particular, are downloaded
+func contentDisposition(fileType, filename string) string {
+	disposition := "attachment"
+	if t, _, err := mime.ParseMediaType(fileType); err == nil && !isActiveType(t) {
+		switch t, _, _ = strings.Cut(t, "/"); t {
+		case "image", "audio", "video":
+			disposition = "inline"
+		}
+	}
+	if s := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); s != "" {
+		return s
 	}
-	return f.r.Read(b)
+	return disposition
 }
 
-func (f *uploadFile) Close() error {
-	if f.r == nil {
-		return fs.ErrClosed
+// isActiveType reports whether browsers may run scripts found in documents of
+// the media type t
+func isActiveType(t string) bool {
+	switch t = strings.ToLower(t); t {
+	case "text/html", "application/xhtml+xml", "text/xml", "application/xml", "text/xsl",
+		"text/javascript", "application/javascript", "application/x-javascript",
+		"application/pdf", "application/x-shockwave-flash":
+		return true
 	}
-	f.r = nil
-	return nil
+	return strings.HasSuffix(t, "+xml")
 }
 
-type uploadsFS struct {
-	stmt *sql.Stmt
+// moveLegacyBlobs moves content of the uploaded files from the files and
+// trash_files tables of databases created before blob storages were supported
+// to the blob storage, and rebuilds these tables without the Bytes column.
+// Each table is checked separately: databases from before the trash was added
+// get the trash_files table created without the Bytes column.
+func moveLegacyBlobs(ctx context.Context, db *sql.DB, blobs blobstore.Store) error {
+	var tables []string
+	for _, table := range [...]string{"files", "trash_files"} {
+		var legacy bool
+		if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pragma_table_info(?) WHERE name='Bytes')`, table).
+			Scan(&legacy); err != nil {
+			return err
+		}
+		if legacy {
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	// blobs are stored one by one outside of a transaction, storing them
+	// again if interrupted is a no-op
+	const hashExpr = `substr(Path,length('.files/')+1,27)`
+	sizes := make(map[string]int64)
+	for _, table := range tables {
+		rows, err := db.QueryContext(ctx, `SELECT DISTINCT `+hashExpr+`, length(Bytes) FROM `+table)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var hash string
+			var size int64
+			if err := rows.Scan(&hash, &size); err != nil {
+				rows.Close()
+				return err
+			}
+			sizes[hash] = size
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	for hash, size := range sizes {
+		var b []byte
+		err := sql.ErrNoRows
+		for _, table := range tables {
+			if err = db.QueryRowContext(ctx, `SELECT Bytes FROM `+table+` WHERE `+hashExpr+`=@hash LIMIT 1`,
+				sql.Named("hash", hash)).Scan(&b); err != sql.ErrNoRows {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := blobs.Put(ctx, hash, bytes.NewReader(b), size); err != nil {
+			return fmt.Errorf("storing %q: %w", hash, err)
+		}
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rebuild := map[string][]string{
+		"files": {
+			`CREATE TABLE files_new(
+				Path TEXT PRIMARY KEY NOT NULL,
+				Hash TEXT NOT NULL,
+				Size INT NOT NULL,
+				Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+				NotePath TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE
+			)`,
+			`INSERT INTO files_new(Path,Hash,Size,Ctime,NotePath)
+				SELECT Path,` + hashExpr + `,length(Bytes),Ctime,NotePath FROM files`,
+			`DROP TABLE files`,
+			`ALTER TABLE files_new RENAME TO files`,
+		},
+		"trash_files": {
+			`CREATE TABLE trash_files_new(
+				Path TEXT NOT NULL,
+				Hash TEXT NOT NULL,
+				Size INT NOT NULL,
+				Ctime INT NOT NULL,
+				TrashID INT NOT NULL REFERENCES trash(ID) ON DELETE CASCADE,
+				PRIMARY KEY(TrashID, Path)
+			)`,
+			`INSERT INTO trash_files_new(Path,Hash,Size,Ctime,TrashID)
+				SELECT Path,` + hashExpr + `,length(Bytes),Ctime,TrashID FROM trash_files`,
+			`DROP TABLE trash_files`,
+			`ALTER TABLE trash_files_new RENAME TO trash_files`,
+		},
+	}
+	for _, table := range tables {
+		for _, s := range rebuild[table] {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return fmt.Errorf("SQL statement %q: %w", s, err)
+			}
+		}
+	}
+	return tx.Commit()
 }
 
-func newUploadsFS(db *sql.DB) uploadsFS {
-	return uploadsFS{stmt: mustPrepare(db, `SELECT Ctime, Bytes FROM files WHERE Path=@path`)}
+// fillFileTypes sets media types of files uploaded before types were stored,
+// guessing them from file name extensions
+func fillFileTypes(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT Path FROM files WHERE Type IS NULL
+		UNION SELECT Path FROM trash_files WHERE Type IS NULL`)
+	if err != nil {
+		return err
+	}
+	types := make(map[string]string)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return err
+		}
+		if t := mime.TypeByExtension(path.Ext(p)); t != "" {
+			types[p] = t
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for p, t := range types {
+		for _, s := range [...]string{
+			`UPDATE files SET Type=@type WHERE Path=@path AND Type IS NULL`,
+			`UPDATE trash_files SET Type=@type WHERE Path=@path AND Type IS NULL`,
+		} {
+			if _, err := tx.ExecContext(ctx, s, sql.Named("path", p), sql.Named("type", t)); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
 }
 
-func (fsys uploadsFS) Open(name string) (fs.File, error) {
-	if !fs.ValidPath(name) {
-		return nil, &fs.PathError{
-			Op:   "open",
-			Path: name,
-			Err:  fs.ErrInvalid,
-		}
-	}
-	var cTime int64
-	var body []byte
-	if err := fsys.stmt.QueryRow(sql.Named("path", name)).Scan(&cTime, &body); err != nil {
-		if err == sql.ErrNoRows {
-			err = fs.ErrNotExist
-		}
-		return nil, &fs.PathError{
-			Op:   "open",
-			Path: name,
-			Err:  err,
-		}
-	}
-	return &uploadFile{
-		r: bytes.NewReader(body),
-		fi: uploadFileInfo{
-			name:  path.Base(name),
-			size:  int64(len(body)),
-			ctime: cTime,
-		},
-	}, nil
+// splitNoteFiles rebuilds the files table of databases created before a file
+// could be shared by several notes without the NotePath column, moving the
+// notes files were uploaded to into the note_files table
+func splitNoteFiles(ctx context.Context, db *sql.DB) error {
+	var legacy bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM pragma_table_info('files') WHERE name='NotePath')`).
+		Scan(&legacy); err != nil || !legacy {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// dropping the old table cascades to note_files, so the links are only
+	// added once the new table is in place
+	for _, s := range [...]string{
+		`CREATE TEMP TABLE note_files_old AS SELECT NotePath, Path, Ctime FROM files WHERE Original IS NULL`,
+		`CREATE TABLE files_new(
+			Path TEXT PRIMARY KEY NOT NULL,
+			Hash TEXT NOT NULL,
+			Size INT NOT NULL,
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+			Original TEXT,
+			SourceHash TEXT,
+			Orphaned INT
+		)`,
+		`INSERT INTO files_new(Path,Hash,Size,Ctime,Original,SourceHash,Orphaned)
+			SELECT Path,Hash,Size,Ctime,Original,SourceHash,Orphaned FROM files`,
+		`DROP TABLE files`,
+		`ALTER TABLE files_new RENAME TO files`,
+		`INSERT OR IGNORE INTO note_files(NotePath,Path,Ctime) SELECT NotePath,Path,Ctime FROM note_files_old`,
+		`DROP TABLE note_files_old`,
+	} {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return fmt.Errorf("SQL statement %q: %w", s, err)
+		}
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/artyom/notes-server/internal/blobstore"
+)
+
+func Test_parseByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  int64
+	}{
+		{"1024", 1024},
+		{"10MiB", 10 << 20},
+		{"1.5 GiB", 3 << 29},
+		{"500KB", 500_000},
+		{"0", 0},
+	} {
+		got, err := parseByteSize(tc.input)
+		if err != nil {
+			t.Errorf("parseByteSize(%q): %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", tc.input, got, tc.want)
+		}
+	}
+	for _, s := range []string{"", "MiB", "-1KiB", "10 parsecs"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("parseByteSize(%q) did not fail", s)
+		}
+	}
+	for _, tc := range []struct {
+		size byteSize
+		want string
+	}{
+		{10 << 20, "10MiB"},
+		{3 << 29, "1.5GiB"},
+		{100, "100B"},
+	} {
+		if got := tc.size.String(); got != tc.want {
+			t.Errorf("byteSize(%d).String() = %q, want %q", tc.size, got, tc.want)
+		}
+	}
+}
+
+func Test_putFileRemovedBlob(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '')`); err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(db)
+	// the first blob stored is removed right away, as if by the garbage
+	// collection running between storing the blob and recording the file
+	h.blobs = &lossyStore{Store: blobs}
+	data := []byte("content")
+	f := fileRecord{Path: ".files/hash/a.txt", Hash: "hash", Size: int64(len(data)), NotePath: "note"}
+	if err := h.putFile(ctx, bytes.NewReader(data), f); err != nil {
+		t.Fatal(err)
+	}
+	r, err := blobs.Get(ctx, "hash")
+	if err != nil {
+		t.Fatalf("blob of the recorded file: %v", err)
+	}
+	r.Close()
+}
+
+type lossyStore struct {
+	blobstore.Store
+	lost bool
+}
+
+func (s *lossyStore) Put(ctx context.Context, key string, r io.ReadSeeker, size int64) error {
+	if err := s.Store.Put(ctx, key, r, size); err != nil || s.lost {
+		return err
+	}
+	s.lost = true
+	return s.Store.Delete(ctx, key)
+}
+
+func Test_uploadType(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`
+	for _, tc := range []struct {
+		name, declared string
+		head           string
+		want           string
+	}{
+		{"a.svg", "", svg, "image/svg+xml"},
+		{"a.svg", "application/octet-stream", svg, "image/svg+xml"},
+		{"page.txt", "text/html; charset=utf-8", "<p>hi</p>", "text/html; charset=utf-8"},
+		{"page.txt", "TEXT/HTML", "<p>hi</p>", "text/html"},
+		{"PHOTO.PNG", "", "", "image/png"},
+		{"photo", "IMAGE/PNG", "", "image/png"},
+		{"notes", "not a type", "plain text", "text/plain; charset=utf-8"},
+		{"page", "", "<html><body>", "text/html; charset=utf-8"},
+	} {
+		if got := uploadType(tc.name, tc.declared, []byte(tc.head)); got != tc.want {
+			t.Errorf("uploadType(%q, %q) = %q, want %q", tc.name, tc.declared, got, tc.want)
+		}
+	}
+}
+
+func Test_contentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		fileType, filename string
+		want               string
+	}{
+		{"image/png", "a.png", "inline; filename=a.png"},
+		{"IMAGE/JPEG", "a.jpg", "inline; filename=a.jpg"},
+		{"video/mp4", "clip.mp4", "inline; filename=clip.mp4"},
+		{"audio/mpeg; charset=x", "a.mp3", "inline; filename=a.mp3"},
+		{"image/svg+xml", "a.svg", "attachment; filename=a.svg"},
+		{"IMAGE/SVG+XML", "a.svg", "attachment; filename=a.svg"},
+		{"text/html; charset=utf-8", "page.html", "attachment; filename=page.html"},
+		{"text/plain", "a.txt", "attachment; filename=a.txt"},
+		{"application/pdf", "a.pdf", "attachment; filename=a.pdf"},
+		{"", "a", "attachment; filename=a"},
+		{"image/png", "my pic.png", `inline; filename="my pic.png"`},
+		{"text/plain", "файл.txt", "attachment; filename*=utf-8''%D1%84%D0%B0%D0%B9%D0%BB.txt"},
+	} {
+		if got := contentDisposition(tc.fileType, tc.filename); got != tc.want {
+			t.Errorf("contentDisposition(%q, %q) = %q, want %q", tc.fileType, tc.filename, got, tc.want)
+		}
+	}
+}
+
+func Test_isActiveType(t *testing.T) {
+	for _, tc := range []struct {
+		t    string
+		want bool
+	}{
+		{"text/html", true},
+		{"TEXT/HTML", true},
+		{"application/xhtml+xml", true},
+		{"image/svg+xml", true},
+		{"Image/SVG+XML", true},
+		{"application/rss+xml", true},
+		{"application/pdf", true},
+		{"text/javascript", true},
+		{"image/png", false},
+		{"text/plain", false},
+		{"application/json", false},
+	} {
+		if got := isActiveType(tc.t); got != tc.want {
+			t.Errorf("isActiveType(%q) = %t, want %t", tc.t, got, tc.want)
+		}
+	}
+}
+
+func Test_filesRedirect(t *testing.T) {
+	base, err := url.Parse("http://files.notes.lan:8080/prefix/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := filesRedirect(base)
+	for _, tc := range []struct {
+		method, target string
+		code           int
+		location       string
+	}{
+		{http.MethodGet, "/.files/h/a.png", http.StatusFound, "http://files.notes.lan:8080/prefix/.files/h/a.png"},
+		{http.MethodHead, "/.files/h/my%20pic.png?x=1", http.StatusFound, "http://files.notes.lan:8080/prefix/.files/h/my%20pic.png"},
+		{http.MethodPost, "/.files/h/a.png", http.StatusMethodNotAllowed, ""},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+		if w.Code != tc.code || w.Header().Get("Location") != tc.location {
+			t.Errorf("%s %s: got %d %q, want %d %q", tc.method, tc.target,
+				w.Code, w.Header().Get("Location"), tc.code, tc.location)
+		}
+	}
+}
+
+func Test_moveLegacyBlobs(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "notes.sqlite")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	// schema of databases created before uploaded files were kept in the
+	// blob storage, or moved to the trash
+	for _, s := range [...]string{
+		`CREATE TABLE notes(
+			Path TEXT PRIMARY KEY NOT NULL,
+			Title TEXT NOT NULL,
+			Text TEXT NOT NULL,
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+			Mtime INT NOT NULL DEFAULT (strftime('%s','now')),
+			Tags TEXT check(Tags is NULL OR(json_valid(Tags) AND json_type(Tags)='array'))
+		)`,
+		`CREATE INDEX notesMtime ON notes(Mtime DESC)`,
+		`CREATE VIRTUAL TABLE notes_fts USING fts5(Path, Title, 'Text', Tags, content=notes)`,
+		`CREATE TRIGGER notes_ai AFTER INSERT ON notes BEGIN
+			INSERT INTO notes_fts(rowid, Path, Title, "Text", Tags)
+				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
+		END`,
+		`CREATE TRIGGER notes_ad AFTER DELETE ON notes BEGIN
+			INSERT INTO notes_fts(notes_fts, rowid, Path, Title, "Text", Tags)
+				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
+		END`,
+		`CREATE TRIGGER notes_au AFTER UPDATE ON notes BEGIN
+			INSERT INTO notes_fts(notes_fts, rowid, Path, Title, "Text", Tags)
+				VALUES ('delete', old.rowid, old.Path, old.Title, old.Text, old.Tags);
+			INSERT INTO notes_fts(rowid, Path, Title, "Text", Tags)
+				VALUES (new.rowid, new.Path, new.Title, new.Text, new.Tags);
+		END`,
+		`CREATE TABLE files(
+			Path TEXT PRIMARY KEY NOT NULL,
+			Bytes BLOB NOT NULL,
+			Ctime INT NOT NULL DEFAULT (strftime('%s','now')),
+			NotePath TEXT NOT NULL REFERENCES notes(Path) ON DELETE CASCADE
+		)`,
+		`INSERT INTO notes(Path, Title, Text) VALUES('note', 'Note', '[file](/.files/qvTGHdzF6KLavt4PO0gs2a6pQ00/a.txt)')`,
+		`INSERT INTO files(Path, Bytes, NotePath) VALUES('.files/qvTGHdzF6KLavt4PO0gs2a6pQ00/a.txt', 'hello', 'note')`,
+	} {
+		if _, err := db.ExecContext(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blobs, err := blobstore.NewSQLite(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initSchema(ctx, db, blobs); err != nil {
+		t.Fatal(err)
+	}
+	const fPath = ".files/qvTGHdzF6KLavt4PO0gs2a6pQ00/a.txt"
+	var hash string
+	var size int64
+	if err := db.QueryRowContext(ctx, `SELECT Hash, Size FROM files WHERE Path=?`, fPath).Scan(&hash, &size); err != nil {
+		t.Fatal(err)
+	}
+	if hash != "qvTGHdzF6KLavt4PO0gs2a6pQ00" || size != 5 {
+		t.Fatalf("got file hash %q and size %d", hash, size)
+	}
+	if got, want := noteFilePaths(t, db, "note"), []string{fPath}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("note files: got %q, want %q", got, want)
+	}
+	r, err := blobs.Get(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if b, err := io.ReadAll(r); err != nil || string(b) != "hello" {
+		t.Fatalf("got blob %q, %v", b, err)
+	}
+}